@@ -0,0 +1,146 @@
+package diag
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------
+// Asynchronous output
+//------------------------------------------------------------
+
+// What to do with a record when async queue is full.
+type OverflowPolicy int
+
+const (
+	// Wait until there is room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// Drop record being logged
+	OverflowDropNewest
+	// Drop oldest queued record to make room
+	OverflowDropOldest
+	// Drop record being logged if it is below given level,
+	// otherwise wait
+	OverflowDropBelow
+)
+
+type asyncWriter struct {
+	queue  chan *entry
+	policy OverflowPolicy
+	level  Level
+	done   chan struct{}
+}
+
+var (
+	// Guards writes to and swaps of log outputs
+	_writeMu sync.Mutex
+
+	// Guards async writer replacement
+	_asyncMu sync.RWMutex
+	_async   *asyncWriter
+
+	// Count of records dropped on queue overflow
+	_dropped atomic.Uint64
+)
+
+// Switches output to asynchronous mode.
+// Records are formatted by the caller and queued, then
+// written to outputs by a separate goroutine. When the queue
+// of given size is full, policy decides what happens.
+// Level is only used by OverflowDropBelow.
+// Size of 0 or less flushes the queue and returns to
+// synchronous mode.
+func SetAsync(size int, policy OverflowPolicy, level Level) {
+	stopAsync()
+	if size <= 0 {
+		return
+	}
+
+	a := &asyncWriter{
+		queue:  make(chan *entry, size),
+		policy: policy,
+		level:  level,
+		done:   make(chan struct{}),
+	}
+	go a.run()
+
+	_asyncMu.Lock()
+	_async = a
+	_asyncMu.Unlock()
+}
+
+// Returns number of records dropped due to async queue overflow.
+func Dropped() uint64 {
+	return _dropped.Load()
+}
+
+// Flushes queued records and stops async writer.
+// Further records are written synchronously.
+func stopAsync() {
+	_asyncMu.Lock()
+	a := _async
+	_async = nil
+	_asyncMu.Unlock()
+
+	if a == nil {
+		return
+	}
+	close(a.queue)
+	<-a.done
+}
+
+// Queues entry if async mode is on.
+// Returns false if entry must be written synchronously.
+func enqueue(e *entry) bool {
+	_asyncMu.RLock()
+	defer _asyncMu.RUnlock()
+
+	a := _async
+	if a == nil {
+		return false
+	}
+
+	policy := a.policy
+	if policy == OverflowDropBelow {
+		if e.level < a.level {
+			policy = OverflowDropNewest
+		} else {
+			policy = OverflowBlock
+		}
+	}
+
+	switch policy {
+	case OverflowDropNewest:
+		select {
+		case a.queue <- e:
+		default:
+			_dropped.Add(1)
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case a.queue <- e:
+				return true
+			default:
+			}
+			select {
+			case <-a.queue:
+				_dropped.Add(1)
+			default:
+			}
+		}
+
+	default:
+		a.queue <- e
+	}
+	return true
+}
+
+// Writer goroutine
+func (a *asyncWriter) run() {
+	for e := range a.queue {
+		write(e)
+	}
+	close(a.done)
+}
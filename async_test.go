@@ -0,0 +1,41 @@
+package diag
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Print goes through async queue, so it stays in order
+// with records and is flushed with them.
+func TestAsyncPrintOrder(t *testing.T) {
+	var buf syncBuffer
+	restore := RedirectOutput(&buf)
+	defer restore()
+
+	SetAsync(16, OverflowBlock, LevelDebug)
+	for i := 0; i < 100; i++ {
+		DEBUG("db", "query", "n", i)
+		Printf("printed %d", i)
+	}
+	SetAsync(0, OverflowBlock, LevelDebug)
+
+	// Plain record may span lines, one of them has the title
+	var order []string
+	for _, line := range buf.Lines() {
+		switch s := string(line); {
+		case strings.Contains(s, "query"):
+			order = append(order, "query")
+		case strings.HasPrefix(s, "printed "):
+			order = append(order, s)
+		}
+	}
+	if len(order) != 200 {
+		t.Fatalf("got %d lines, want 200", len(order))
+	}
+	for i := 0; i < 100; i++ {
+		if order[2*i] != "query" || order[2*i+1] != fmt.Sprintf("printed %d", i) {
+			t.Fatalf("out of order at %d: %q", i, order[2*i:2*i+2])
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package diag
+
+import (
+	"io"
+	"testing"
+)
+
+// Runs DEBUG call with typical arguments, in synchronous
+// and async output mode, plain output discarded.
+func benchDEBUG(b *testing.B, level Level) {
+	restore := RedirectOutput(io.Discard)
+	defer restore()
+	SetLevel(level)
+	defer SetLevel(LevelDebug)
+
+	run := func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			DEBUG("db", "query", "table", "users", "rows", 1000, "ok", true)
+		}
+	}
+
+	b.Run("sync", run)
+	b.Run("async", func(b *testing.B) {
+		SetAsync(1024, OverflowBlock, LevelDebug)
+		defer SetAsync(0, OverflowBlock, LevelDebug)
+		run(b)
+	})
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	benchDEBUG(b, LevelWarning)
+}
+
+func BenchmarkEnabled(b *testing.B) {
+	benchDEBUG(b, LevelDebug)
+}
@@ -0,0 +1,57 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------
+// Command notifier
+//------------------------------------------------------------
+
+const commandTimeout = 30 * time.Second
+
+// Executes local command with SOS record as JSON on stdin.
+// Command is killed if it runs longer than Timeout.
+type CommandNotifier struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+func NewCommandNotifier(path string, args ...string) *CommandNotifier {
+	return &CommandNotifier{Path: path, Args: args}
+}
+
+// Identifies notifier in spool
+func (n *CommandNotifier) String() string {
+	return "command " + n.Path
+}
+
+func (n *CommandNotifier) Notify(rec *Record) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	timeout := n.Timeout
+	if timeout <= 0 {
+		timeout = commandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, n.Path, n.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("diag: command %s: %w: %s", n.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package diag
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime/debug"
+	"time"
+)
+
+//------------------------------------------------------------
+// Crash capture
+//------------------------------------------------------------
+
+const (
+	crashFilename = "crash.log"
+	crashMaxSize  = 64 * 1024
+)
+
+var _crashCapture bool
+
+// Enables capture of fatal runtime output into crash file
+// under log directory. That includes unrecovered panics,
+// fatal errors and unhandled signals such as SIGSEGV.
+// If previous run crashed, its output is reported as SOS
+// on next Start. Must be called before Start. Report is
+// spooled if neither email nor notifiers are set up yet, and
+// sent once either is.
+func SetCrashCapture(enabled bool) {
+	_crashCapture = enabled
+}
+
+// Reports crash left by previous run, then
+// redirects runtime fatal output to a fresh crash file.
+func startCrashCapture(directory string) error {
+	dir := path.Join(directory, "crash")
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	fname := path.Join(dir, crashFilename)
+
+	// Previous run crashed if its crash file isn't empty
+	if fi, err := os.Stat(fname); err == nil && fi.Size() > 0 {
+		reportCrash(dir, fname, fi)
+	}
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Runtime duplicates file descriptor, so it is safe to close
+	return debug.SetCrashOutput(f, debug.CrashOptions{})
+}
+
+// Archives crash file and sends its contents as SOS.
+func reportCrash(dir, fname string, fi os.FileInfo) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		SOS("diag", "Previous run crashed, error reading crash file", "err", err, "file", fname)
+		return
+	}
+
+	// Keep crash file next to current one
+	archived := path.Join(dir, "crash_"+fi.ModTime().Format(time.Stamp)+".log")
+	if err := os.Rename(fname, archived); err != nil {
+		archived = fname
+	}
+
+	output := string(data)
+	if len(output) > crashMaxSize {
+		output = output[:crashMaxSize] + "\n... (truncated)"
+	}
+
+	title := "Previous run crashed"
+	args := []interface{}{
+		"crashed at", fi.ModTime().Format(time.ANSIC),
+		"file", archived,
+		"output", output,
+	}
+
+	// Nowhere to send it yet, so it waits in spool
+	if !notificationsSet() {
+		spool(&spoolEntry{Record: &Record{
+			Level:  LevelSOS,
+			Time:   time.Now(),
+			Name:   "diag",
+			Title:  title,
+			Args:   args,
+			Caller: externalCaller(),
+			Meta:   Metadata(),
+		}})
+	}
+	SOS("diag", title, args...)
+
+	cleanLogs(dir, _logger.historySize)
+}
@@ -0,0 +1,85 @@
+package diag
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime/debug"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Notifier that keeps received records
+type recordNotifier struct {
+	mu   sync.Mutex
+	recs []*Record
+}
+
+func (n *recordNotifier) Notify(rec *Record) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.recs = append(n.recs, rec)
+	return nil
+}
+
+func (n *recordNotifier) records() []*Record {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.recs
+}
+
+func TestCrashReportSpooled(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, "crash"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "crash", crashFilename), []byte("fatal error: boom"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	prevLogger, prevOutputs, prevEmail := _logger, _outputs.Load(), emailNotifier()
+	setEmailNotifier(nil)
+	SetCrashCapture(true)
+	defer func() {
+		SetCrashCapture(false)
+		debug.SetCrashOutput(nil, debug.CrashOptions{})
+		_logger = prevLogger
+		_outputs.Store(prevOutputs)
+		setEmailNotifier(prevEmail)
+	}()
+
+	// Nothing to notify at Start, report waits in spool
+	if err := Start(dir, "app.log", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitNotifications(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fis, _ := ioutil.ReadDir(path.Join(dir, "spool"))
+	if len(fis) != 1 {
+		t.Fatalf("got %d spool files, want 1", len(fis))
+	}
+
+	// Sent when notifier is added
+	n := &recordNotifier{}
+	AddNotifier(n)
+	defer RemoveNotifier(n)
+	if err := WaitNotifications(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := n.records()
+	if len(recs) != 1 || recs[0].Title != "Previous run crashed" {
+		t.Fatalf("got %v", recs)
+	}
+	if len(recs[0].Recent) != 0 {
+		t.Errorf("report got recent records of this run: %v", recs[0].Recent)
+	}
+	if fis, _ := ioutil.ReadDir(path.Join(dir, "spool")); len(fis) != 0 {
+		t.Errorf("got %d spool files after replay", len(fis))
+	}
+}
@@ -2,18 +2,19 @@
 package diag
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/deze333/diag/plain"
-	"github.com/deze333/diag/util"
-	"github.com/deze333/diag/xterm"
 )
 
 //------------------------------------------------------------
@@ -25,36 +26,67 @@ type loggers struct {
 	tstamp   time.Time
 	timer    *time.Timer
 
-	xtermLog *log.Logger
-
 	plainFileDir string
 	plainFile    *os.File
-	plainLog     *log.Logger
 
 	htmlFileDir string
 	htmlFile    *os.File
-	htmlLog     *log.Logger
+
+	spoolDir string
 
 	historySize int
 }
 
-var _logger *loggers
+// Writers records are output to. Replaced as a whole under
+// _writeMu, so records are formatted without taking the lock.
+type outputs struct {
+	xterm io.Writer
+	plain io.Writer
+	html  io.Writer
+	json  io.Writer
+}
+
+var (
+	_logger  *loggers
+	_outputs atomic.Pointer[outputs]
+)
 
 //------------------------------------------------------------
 // Init
 //------------------------------------------------------------
 
 func minStart() {
-	if _logger != nil && _logger.xtermLog != nil {
-		_logger.xtermLog.Print(xterm.WARNING(
-			time.Now(),
-			"diag",
-			"package diag config not provided, assuming screen only output"))
-	} else {
-		fmt.Println("[diag] package diag config not provided, assuming screen only output")
+	_writeMu.Lock()
+	defer _writeMu.Unlock()
+	if _outputs.Load() != nil {
+		return
 	}
+
+	fmt.Println("[diag] package diag config not provided, assuming screen only output")
 	_logger = &loggers{}
-	_logger.xtermLog = log.New(os.Stdout, "", 0)
+	_outputs.Store(&outputs{xterm: os.Stdout})
+}
+
+// Returns current outputs, assuming screen only output
+// if package wasn't started.
+func loadOutputs() *outputs {
+	o := _outputs.Load()
+	if o == nil {
+		minStart()
+		o = _outputs.Load()
+	}
+	return o
+}
+
+// Replaces outputs with their copy changed by fn.
+// Caller must hold _writeMu.
+func setOutputs(fn func(o *outputs)) {
+	var o outputs
+	if cur := _outputs.Load(); cur != nil {
+		o = *cur
+	}
+	fn(&o)
+	_outputs.Store(&o)
 }
 
 //------------------------------------------------------------
@@ -65,19 +97,56 @@ func SetHistory(size int) {
 	_logger.historySize = size
 }
 
+// Adds JSON lines output to given writer, one record per line.
+// Must be called after Start. Nil writer stops JSON output.
+func SetJSONOutput(w io.Writer) {
+	loadOutputs()
+
+	_writeMu.Lock()
+	defer _writeMu.Unlock()
+	setOutputs(func(o *outputs) {
+		o.json = w
+	})
+}
+
+// Replaces screen, file and JSON outputs with plain text
+// output to given writer, one write per record. Nil writer
+// discards all output. Returned func restores previous outputs.
+// Meant for tests, see diagtest.
+func RedirectOutput(w io.Writer) (restore func()) {
+	loadOutputs()
+
+	_writeMu.Lock()
+	prev := _outputs.Load()
+	_outputs.Store(&outputs{plain: w})
+	_writeMu.Unlock()
+
+	return func() {
+		_writeMu.Lock()
+		_outputs.Store(prev)
+		_writeMu.Unlock()
+	}
+}
+
 func Start(directory string, filename string, xterm, plain, html bool) (err error) {
 	_logger = &loggers{}
 	_logger.historySize = 3
 
 	// Default screen output
+	_writeMu.Lock()
+	_outputs.Store(&outputs{})
 	if xterm {
-		_logger.xtermLog = log.New(os.Stdout, "", 0)
+		setOutputs(func(o *outputs) {
+			o.xterm = os.Stdout
+		})
 	}
+	_writeMu.Unlock()
 
 	if filename == "" || directory == "" {
 		return
 	}
 	_logger.fnametpl = filename
+	_logger.spoolDir = path.Join(directory, "spool")
 
 	// Mark start time
 	_logger.tstamp = time.Now()
@@ -103,7 +172,11 @@ func Start(directory string, filename string, xterm, plain, html bool) (err erro
 			return err
 		}
 		_logger.plainFile = f
-		_logger.plainLog = log.New(f, "", 0)
+		_writeMu.Lock()
+		setOutputs(func(o *outputs) {
+			o.plain = f
+		})
+		_writeMu.Unlock()
 	}
 
 	// Log file for HTML
@@ -118,14 +191,29 @@ func Start(directory string, filename string, xterm, plain, html bool) (err erro
 			return err
 		}
 		_logger.htmlFile = f
-		_logger.htmlLog = log.New(f, "", 0)
+		_writeMu.Lock()
+		setOutputs(func(o *outputs) {
+			o.html = f
+		})
+		_writeMu.Unlock()
+	}
+
+	// Capture of fatal runtime output
+	if _crashCapture {
+		if err := startCrashCapture(directory); err != nil {
+			return err
+		}
 	}
 
+	// Notifications spooled by previous run
+	replaySpool()
+
 	return
 }
 
 // Rotates logs
 func rotateLogs() {
+	_metrics.rotations.Add(1)
 	DEBUG("diag", "Rotating logs", "closing time stamp", _logger.tstamp.Format(time.ANSIC))
 	// Close current logs
 	// Rename defaut logs that are about to be closed timestamped
@@ -135,9 +223,11 @@ func rotateLogs() {
 	// Plain log
 	if _logger.plainFile != nil {
 		// Stop logging and close file
+		_writeMu.Lock()
 		f := _logger.plainFile
 		_logger.plainFile = nil
 		f.Close()
+		_writeMu.Unlock()
 		// Rename file
 		err := os.Rename(
 			f.Name(),
@@ -146,22 +236,30 @@ func rotateLogs() {
 			SOS("diag", "Error renaming plain log file. Plain logging stopped.", "msg", err)
 		} else {
 			// Create new logging file with default name (ie, webapp.log)
-			f, err := os.Create(path.Join(_logger.plainFileDir, filename))
+			nf, err := os.Create(path.Join(_logger.plainFileDir, filename))
 			if err != nil {
 				SOS("diag", "Error creating plain log file. Plain logging stopped.", "msg", err)
 			} else {
-				// Start logging
-				_logger.plainFile = f
-				_logger.plainLog = log.New(f, "", 0)
+				// Start logging, unless output is redirected
+				_writeMu.Lock()
+				_logger.plainFile = nf
+				setOutputs(func(o *outputs) {
+					if o.plain == f {
+						o.plain = nf
+					}
+				})
+				_writeMu.Unlock()
 			}
 		}
 	}
 
 	// Html log
 	if _logger.htmlFile != nil {
+		_writeMu.Lock()
 		f := _logger.htmlFile
 		_logger.htmlFile = nil
 		f.Close()
+		_writeMu.Unlock()
 	}
 
 	// Set new logging start time
@@ -245,6 +343,8 @@ func (f FilesByDate) Swap(i, j int) {
 func Close() {
 	DEBUG("diag", "Closing log file output")
 
+	_writeMu.Lock()
+	defer _writeMu.Unlock()
 	if _logger.plainFile != nil {
 		_logger.plainFile.Close()
 		_logger.plainFile = nil
@@ -255,180 +355,199 @@ func Close() {
 	}
 }
 
-// Print log
-func Print(v ...interface{}) {
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Print(v...)
+// Gracefully shuts down file based log output.
+// Stops log rotation, waits for notifications being sent
+// until ctx is done, writes footers, then flushes and closes
+// log files. Screen output will still work.
+// Returns all errors encountered joined together.
+func Shutdown(ctx context.Context) error {
+	if _logger == nil {
+		flushEmailDigest()
+		abortRetries()
+		return WaitNotifications(ctx)
 	}
 
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Print(v...)
-	}
+	DEBUG("diag", "Shutting down log output")
+	var errs []error
 
-	// HTML file output
-	if _logger.htmlLog != nil {
-		_logger.htmlLog.Print(v...)
+	// No more rotations
+	if _logger.timer != nil {
+		_logger.timer.Stop()
+		_logger.timer = nil
 	}
-}
 
-// Prinft log
-func Printf(format string, v ...interface{}) {
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Printf(format, v...)
-	}
-
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Printf(format, v...)
-	}
+	// Final digest of throttled emails,
+	// failing notifications are spooled without more retries
+	flushEmailDigest()
+	abortRetries()
 
-	// HTML file output
-	if _logger.htmlLog != nil {
-		_logger.htmlLog.Printf(format, v...)
+	// Notifications may still log errors, so files stay open
+	if err := WaitNotifications(ctx); err != nil {
+		errs = append(errs, err)
 	}
-}
 
-// Outputs debug message to at least screen logger.
-// If file based loggers were configured then
-// they will record that message too.
-func DEBUG(name, title string, v ...interface{}) {
-	if _logger == nil {
-		minStart()
-	}
+	// Summaries of suppressed records, then flush async queue
+	flushSampling()
+	stopAsync()
 
 	t := time.Now()
+	_writeMu.Lock()
+	defer _writeMu.Unlock()
 
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Print(xterm.DEBUG(t, name, title, v...))
+	// Plain log
+	if _logger.plainFile != nil {
+		f := _logger.plainFile
+		fmt.Fprintln(f, plain.FOOTER(t))
+		_logger.plainFile = nil
+		setOutputs(func(o *outputs) {
+			if o.plain == f {
+				o.plain = nil
+			}
+		})
+		errs = append(errs, syncClose(f))
 	}
 
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Print(plain.DEBUG(t, name, title, v...))
+	// Html log
+	if _logger.htmlFile != nil {
+		f := _logger.htmlFile
+		_logger.htmlFile = nil
+		setOutputs(func(o *outputs) {
+			if o.html == f {
+				o.html = nil
+			}
+		})
+		errs = append(errs, syncClose(f))
 	}
 
-	// HTML file output
-	if _logger.htmlLog != nil {
-		//_logger.htmlLog.Printf(format, v...)
-	}
+	return errors.Join(errs...)
 }
 
-// Simple NOTE
-func NOTE(msg string, v ...interface{}) {
-	if _logger == nil {
-		minStart()
+// Flushes file to disk and closes it.
+func syncClose(f *os.File) error {
+	err := f.Sync()
+	if errc := f.Close(); err == nil {
+		err = errc
 	}
-
-	t := time.Now()
-
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Print(xterm.NOTE(t, msg, v...))
+	if err != nil {
+		return fmt.Errorf("diag: closing %s: %w", f.Name(), err)
 	}
+	return nil
+}
 
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Print(plain.NOTE(t, msg, v...))
-	}
+// Print log
+func Print(v ...interface{}) {
+	printText(fmt.Sprint(v...))
+}
 
-	// HTML file output
-	if _logger.htmlLog != nil {
-		//_logger.htmlLog.Printf(format, v...)
-	}
+// Prinft log
+func Printf(format string, v ...interface{}) {
+	printText(fmt.Sprintf(format, v...))
 }
 
-// Simple NOTE 2 (Inverse color)
-func NOTE2(msg string, v ...interface{}) {
-	if _logger == nil {
-		minStart()
+// Writes text line to screen, plain and HTML outputs,
+// directly or via async queue, in order with records.
+func printText(s string) {
+	o := loadOutputs()
+	if o.xterm == nil && o.plain == nil && o.html == nil {
+		return
 	}
 
-	t := time.Now()
-
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Print(xterm.NOTE2(t, msg, v...))
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
 	}
-
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Print(plain.NOTE(t, msg, v...))
+	// Overflow policy treats text as NOTE
+	e := newEntry(LevelNote)
+	if o.xterm != nil {
+		e.xterm = append(e.xterm, s...)
 	}
-
-	// HTML file output
-	if _logger.htmlLog != nil {
-		//_logger.htmlLog.Printf(format, v...)
+	if o.plain != nil {
+		e.plain = append(e.plain, s...)
+	}
+	if o.html != nil {
+		e.html = append(e.html, s...)
+	}
+	if enqueue(e) {
+		return
 	}
+	write(e)
 }
 
-// Outputs WARNING message
-func WARNING(name, title string, v ...interface{}) {
-	if _logger == nil {
-		minStart()
+// Outputs debug message to at least screen logger.
+// If file based loggers were configured then
+// they will record that message too.
+func DEBUG(name, title string, v ...interface{}) {
+	if !admit(LevelDebug, name, title) {
+		return
 	}
+	v = attachStack(LevelDebug, v)
+	output(&Record{Level: LevelDebug, Time: time.Now(), Name: name, Title: title}, v)
+}
 
-	t := time.Now()
-
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Print(xterm.WARNING(t, name, title, v...))
+// Simple NOTE
+func NOTE(msg string, v ...interface{}) {
+	if !admit(LevelNote, "", msg) {
+		return
 	}
+	v = attachStack(LevelNote, v)
+	output(&Record{Level: LevelNote, Time: time.Now(), Title: msg}, v)
+}
 
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Print(plain.WARNING(t, name, title, v...))
+// Simple NOTE 2 (Inverse color)
+func NOTE2(msg string, v ...interface{}) {
+	if !admit(LevelNote, "", msg) {
+		return
 	}
+	v = attachStack(LevelNote, v)
+	output(&Record{Level: LevelNote, Time: time.Now(), Title: msg, inverse: true}, v)
+}
 
-	// HTML file output
-	if _logger.htmlLog != nil {
-		//_logger.htmlLog.Printf(format, v...)
+// Outputs WARNING message
+func WARNING(name, title string, v ...interface{}) {
+	if !admit(LevelWarning, name, title) {
+		return
 	}
+	v = attachStack(LevelWarning, v)
+	output(&Record{Level: LevelWarning, Time: time.Now(), Name: name, Title: title}, v)
 }
 
 // Outputs ERROR message
 func ERROR(name, title string, v ...interface{}) {
-	if _logger == nil {
-		minStart()
-	}
-
-	t := time.Now()
-
-	// Xterm screen log
-	if _logger.xtermLog != nil {
-		_logger.xtermLog.Print(xterm.ERROR(t, name, title, v...))
-	}
-
-	// Plain file output
-	if _logger.plainLog != nil {
-		_logger.plainLog.Print(plain.ERROR(t, name, title, v...))
-	}
-
-	// HTML file output
-	if _logger.htmlLog != nil {
-		//_logger.htmlLog.Printf(format, v...)
+	if !admit(LevelError, name, title) {
+		return
 	}
+	v = attachStack(LevelError, v)
+	output(&Record{Level: LevelError, Time: time.Now(), Name: name, Title: title}, v)
 }
 
 // Outputs SOS message to at least screen logger.
 // And attempts to immediately contact a human.
 // If file based loggers were configured then
 // they will record that message too.
-// NEW: Add "stack" as the last of v and stack trace will be appended.
+// Add WithStack() to v and stack trace will be appended.
+// Trailing "stack" argument still works the same, but is
+// deprecated and warned about once.
 func SOS(name, title string, v ...interface{}) {
-	if len(v) != 0 && fmt.Sprint(v[len(v)-1]) == "stack" {
-		v = append(v, util.Stack())
+	if !sampleSOS(name, title) {
+		return
 	}
-	notifyEmail(name, title, v...)
-	ERROR(name, title, v...)
+	v = attachStack(LevelSOS, stackMarker(v))
+	sos(&Record{Level: LevelSOS, Time: time.Now(), Name: name, Title: title, Args: v})
 }
 
+// Same as SOS with WithStack() added to v.
 func SOS_Stack(name, title string, v ...interface{}) {
-	v = append(v, "stack")
-	v = append(v, util.Stack())
-	notifyEmail(name, title, v...)
-	ERROR(name, title, v...)
+	if !sampleSOS(name, title) {
+		return
+	}
+	v = attachStack(LevelSOS, append(v, WithStack()))
+	sos(&Record{Level: LevelSOS, Time: time.Now(), Name: name, Title: title, Args: v})
+}
+
+// Notifies about SOS record, then outputs it.
+func sos(rec *Record) {
+	notify(rec)
+	if !Enabled(LevelSOS) {
+		return
+	}
+	output(rec, rec.Args)
 }
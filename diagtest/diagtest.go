@@ -0,0 +1,231 @@
+// Test helpers that capture diag records in memory
+package diagtest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/deze333/diag"
+	"github.com/deze333/diag/field"
+)
+
+//------------------------------------------------------------
+// Capture
+//------------------------------------------------------------
+
+// Records captured during a test.
+type Recorder struct {
+	t       testing.TB
+	c       <-chan diag.Record
+	flush   chan chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+	recs    []diag.Record
+	dropped uint64
+}
+
+// Records delivered but not yet received by recorder,
+// older ones are dropped when it falls behind
+const captureSize = 10000
+
+var (
+	_currentMu sync.Mutex
+	_current   *Recorder
+)
+
+// Captures records of all levels logged until test ends.
+// Screen and file output is discarded meanwhile, records are
+// forwarded to t.Log as they arrive instead, so they show for
+// failing tests. Test fails if recorder falls behind and records
+// are dropped. Previous outputs are restored on t.Cleanup.
+// Capture is global, so tests using it can't run in parallel.
+func Capture(t testing.TB) *Recorder {
+	t.Helper()
+	c, cancel := diag.Subscribe(diag.Filter{
+		Level:  diag.LevelDebug,
+		Size:   captureSize,
+		Policy: diag.OverflowDropOldest,
+	})
+	restore := diag.RedirectOutput(nil)
+	r := &Recorder{
+		t:     t,
+		c:     c,
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go r.receive()
+
+	_currentMu.Lock()
+	prev := _current
+	_current = r
+	_currentMu.Unlock()
+
+	t.Cleanup(func() {
+		r.Records()
+		cancel()
+		<-r.done
+		restore()
+		_currentMu.Lock()
+		_current = prev
+		_currentMu.Unlock()
+	})
+	return r
+}
+
+// Receives records until subscription is cancelled.
+// Flush requests are answered once delivered records are
+// received, so reads see all records logged before them.
+func (r *Recorder) receive() {
+	defer close(r.done)
+	for {
+		select {
+		case rec, ok := <-r.c:
+			if !ok {
+				return
+			}
+			r.add(rec)
+		case flushed := <-r.flush:
+			for n := len(r.c); n > 0; n-- {
+				r.add(<-r.c)
+			}
+			close(flushed)
+		}
+	}
+}
+
+// Keeps record and forwards it to t.Log.
+func (r *Recorder) add(rec diag.Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recs = append(r.recs, rec)
+	r.t.Log(rec.String())
+}
+
+// Waits until delivered records are received and fails
+// test if any were dropped since last check.
+func (r *Recorder) sync() {
+	r.t.Helper()
+	flushed := make(chan struct{})
+	select {
+	case r.flush <- flushed:
+		<-flushed
+	case <-r.done:
+	}
+
+	// Count is 0 once subscription is cancelled
+	dropped := diag.SubscriberDropped(r.c)
+	var n uint64
+	r.mu.Lock()
+	if dropped > r.dropped {
+		n = dropped - r.dropped
+		r.dropped = dropped
+	}
+	r.mu.Unlock()
+	if n != 0 {
+		r.t.Errorf("diagtest: %d records dropped, capture buffer of %d is full", n, captureSize)
+	}
+}
+
+// Returns records captured so far, oldest first.
+func (r *Recorder) Records() []diag.Record {
+	r.t.Helper()
+	r.sync()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]diag.Record(nil), r.recs...)
+}
+
+// Forgets records captured so far.
+func (r *Recorder) Reset() {
+	r.t.Helper()
+	r.sync()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recs = nil
+}
+
+// Returns records of given level and name whose title
+// contains titleSubstr. Empty name matches all names.
+func (r *Recorder) Find(level diag.Level, name, titleSubstr string) []diag.Record {
+	r.t.Helper()
+	var found []diag.Record
+	for _, rec := range r.Records() {
+		if rec.Level == level && (name == "" || rec.Name == name) && strings.Contains(rec.Title, titleSubstr) {
+			found = append(found, rec)
+		}
+	}
+	return found
+}
+
+// Fails test unless a record of given level and name with
+// title containing titleSubstr was captured. Returns the
+// last such record.
+func (r *Recorder) AssertLogged(level diag.Level, name, titleSubstr string) diag.Record {
+	r.t.Helper()
+	found := r.Find(level, name, titleSubstr)
+	if len(found) == 0 {
+		r.t.Fatalf("diagtest: no %s record %q with title containing %q", level, name, titleSubstr)
+		return diag.Record{}
+	}
+	return found[len(found)-1]
+}
+
+// Fails test if a record of given level and name with
+// title containing titleSubstr was captured.
+func (r *Recorder) AssertNotLogged(level diag.Level, name, titleSubstr string) {
+	r.t.Helper()
+	if found := r.Find(level, name, titleSubstr); len(found) != 0 {
+		r.t.Fatalf("diagtest: unexpected %s record: %s", level, found[0].String())
+	}
+}
+
+// Same as Recorder.AssertLogged of current capture.
+func AssertLogged(t testing.TB, level diag.Level, name, titleSubstr string) diag.Record {
+	t.Helper()
+	return current(t).AssertLogged(level, name, titleSubstr)
+}
+
+// Same as Recorder.AssertNotLogged of current capture.
+func AssertNotLogged(t testing.TB, level diag.Level, name, titleSubstr string) {
+	t.Helper()
+	current(t).AssertNotLogged(level, name, titleSubstr)
+}
+
+func current(t testing.TB) *Recorder {
+	t.Helper()
+	_currentMu.Lock()
+	r := _current
+	_currentMu.Unlock()
+	if r == nil {
+		t.Fatal("diagtest: Capture not called")
+	}
+	return r
+}
+
+//------------------------------------------------------------
+// Fields
+//------------------------------------------------------------
+
+// Returns arguments of record by key. Single argument
+// without key is returned under empty key.
+func Fields(rec diag.Record) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if field.IsSingle(rec.Args) {
+		fields[""] = rec.Args[0]
+		return fields
+	}
+	for it := field.Iterate(rec.Args); it.More(); {
+		f, _ := it.Next()
+		if !f.IsSeparator() {
+			fields[f.Key] = f.Value()
+		}
+	}
+	return fields
+}
+
+// Returns argument of record by key.
+func Field(rec diag.Record, key string) (interface{}, bool) {
+	v, ok := Fields(rec)[key]
+	return v, ok
+}
@@ -0,0 +1,103 @@
+package diagtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deze333/diag"
+)
+
+func TestCapture(t *testing.T) {
+	r := Capture(t)
+	diag.WARNING("db", "slow query", "ms", 900)
+	diag.DEBUG("cache", "miss")
+
+	rec := r.AssertLogged(diag.LevelWarning, "db", "slow")
+	if v, _ := Field(rec, "ms"); v != 900 {
+		t.Errorf("ms = %v", v)
+	}
+	r.AssertNotLogged(diag.LevelError, "", "")
+
+	r.Reset()
+	if recs := r.Records(); len(recs) != 0 {
+		t.Errorf("got %d records after Reset", len(recs))
+	}
+}
+
+// Captures start and end while another goroutine keeps
+// logging, run with -race to check output swaps.
+func TestCaptureConcurrent(t *testing.T) {
+	restore := diag.RedirectOutput(nil)
+	defer restore()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				diag.DEBUG("worker", "tick")
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 20; i++ {
+		t.Run("capture", func(t *testing.T) {
+			Capture(t)
+			diag.NOTE("captured")
+			AssertLogged(t, diag.LevelNote, "", "captured")
+		})
+	}
+}
+
+// TB that keeps failures and runs cleanups when told
+type fakeTB struct {
+	testing.TB
+	mu       sync.Mutex
+	errors   []string
+	cleanups []func()
+}
+
+func (tb *fakeTB) Helper()                 {}
+func (tb *fakeTB) Log(args ...interface{}) {}
+func (tb *fakeTB) Cleanup(f func())        { tb.cleanups = append(tb.cleanups, f) }
+func (tb *fakeTB) Errorf(format string, args ...interface{}) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func (tb *fakeTB) cleanup() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}
+
+// Earlier drops aren't reported again once subscription ends
+func TestRecordsAfterCleanup(t *testing.T) {
+	tb := &fakeTB{}
+	r := Capture(tb)
+	diag.NOTE("captured")
+	r.mu.Lock()
+	r.dropped = 3
+	r.mu.Unlock()
+
+	tb.cleanup()
+	if recs := r.Records(); len(recs) != 1 {
+		t.Errorf("got %d records", len(recs))
+	}
+	if len(tb.errors) != 0 {
+		t.Errorf("failures %q", tb.errors)
+	}
+}
@@ -0,0 +1,144 @@
+package diagtest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deze333/diag"
+)
+
+//------------------------------------------------------------
+// Notifications
+//------------------------------------------------------------
+
+// SOS notifications captured during a test.
+// Emails keep their rendered subject, text and HTML,
+// records are those passed to notifiers.
+type Notifications struct {
+	t       testing.TB
+	mu      sync.Mutex
+	emails  []diag.EmailMessage
+	records []diag.Record
+}
+
+// How long reads wait for notifications being sent
+const waitTimeout = 5 * time.Second
+
+// Captures SOS emails and notifier records until test ends,
+// instead of sending them. Email sender, recipients, routes and
+// templates stay as configured. Email throttling, digest and
+// sampling start afresh, so earlier tests don't suppress
+// notifications of this one. Previous state and email
+// notification are restored on t.Cleanup. Call Capture first,
+// so notifications spooled in a real log directory aren't
+// replayed to the test.
+func CaptureNotifications(t testing.TB) *Notifications {
+	t.Helper()
+	n := &Notifications{t: t}
+	restoreThrottling := diag.ResetThrottling()
+	restore := diag.RedirectEmailNotification(n.sendEmail)
+	diag.AddNotifier(n)
+
+	t.Cleanup(func() {
+		n.Wait()
+		diag.RemoveNotifier(n)
+		restore()
+		restoreThrottling()
+	})
+	return n
+}
+
+func (n *Notifications) sendEmail(msg *diag.EmailMessage) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.emails = append(n.emails, *msg)
+	return nil
+}
+
+// Records notification, implements diag.Notifier.
+func (n *Notifications) Notify(rec *diag.Record) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.records = append(n.records, *rec)
+	return nil
+}
+
+func (n *Notifications) String() string {
+	return "diagtest"
+}
+
+// Waits until all notifications being sent are done,
+// fails test if that takes too long.
+func (n *Notifications) Wait() {
+	n.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := diag.WaitNotifications(ctx); err != nil {
+		n.t.Fatal("diagtest: ", err)
+	}
+}
+
+// Returns emails sent so far, after waiting for pending ones.
+// Every recipient gets own copy.
+func (n *Notifications) Emails() []diag.EmailMessage {
+	n.t.Helper()
+	n.Wait()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]diag.EmailMessage(nil), n.emails...)
+}
+
+// Returns records sent to notifiers so far,
+// after waiting for pending ones.
+func (n *Notifications) Records() []diag.Record {
+	n.t.Helper()
+	n.Wait()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]diag.Record(nil), n.records...)
+}
+
+// Returns emails whose subject contains subjectSubstr, sent to
+// given email address. Empty address matches all recipients.
+func (n *Notifications) Find(to, subjectSubstr string) []diag.EmailMessage {
+	n.t.Helper()
+	var found []diag.EmailMessage
+	for _, m := range n.Emails() {
+		if (to == "" || m.Recipient["email"] == to) && strings.Contains(m.Subject, subjectSubstr) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// Fails test unless an email with subject containing
+// subjectSubstr was sent to given address, or to anyone
+// if address is empty. Returns the last such email.
+func (n *Notifications) AssertSent(to, subjectSubstr string) diag.EmailMessage {
+	n.t.Helper()
+	found := n.Find(to, subjectSubstr)
+	if len(found) == 0 {
+		n.t.Fatalf("diagtest: no email to %q with subject containing %q, sent %d", to, subjectSubstr, len(n.Emails()))
+		return diag.EmailMessage{}
+	}
+	return found[len(found)-1]
+}
+
+// Fails test if any email was sent.
+func (n *Notifications) AssertNotSent() {
+	n.t.Helper()
+	if emails := n.Emails(); len(emails) != 0 {
+		n.t.Fatalf("diagtest: unexpected email: %s", emails[0].Subject)
+	}
+}
+
+// Fails test unless email text or HTML body contains s.
+func AssertBodyContains(t testing.TB, msg diag.EmailMessage, s string) {
+	t.Helper()
+	if !strings.Contains(msg.Text, s) && !strings.Contains(msg.HTML, s) {
+		t.Fatalf("diagtest: email %q body doesn't contain %q", msg.Subject, s)
+	}
+}
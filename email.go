@@ -1,12 +1,9 @@
 package diag
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"strings"
-	"text/template"
-
-	"github.com/deze333/m8l"
+	"sync"
 )
 
 //------------------------------------------------------------
@@ -18,133 +15,273 @@ type EmailNotifier struct {
 	recipient     map[string]string
 	subjectPrefix string
 	sendProc      func(sender, recipient map[string]string, subj, body string)
+	send          func(msg *EmailMessage) error
+}
+
+// Rendered SOS email with plain text and HTML alternatives.
+// Sender and recipient are as given to notification setup.
+type EmailMessage struct {
+	Sender    map[string]string
+	Recipient map[string]string
+	Subject   string
+	Text      string
+	HTML      string
 }
 
-var _emailNotifier *EmailNotifier
+var (
+	// Guards email notification replacement
+	_emailMu       sync.RWMutex
+	_emailNotifier *EmailNotifier
+)
+
+// Tracks notifications being sent
+var _notifying struct {
+	sync.Mutex
+	pending int
+	idle    chan struct{}
+}
 
 //------------------------------------------------------------
 //
 //------------------------------------------------------------
 
+// Sets SOS email notification sent via SMTP. Sender keys:
+//
+//	identity  sender name in From header
+//	email     sender address, also SMTP user name
+//	server    SMTP server host
+//	port      SMTP server port, 587 by default
+//	password  SMTP password, no authentication if empty
+//
+// Recipient has "identity" and "email" keys, as do recipients
+// of email routes. Incomplete sender is reported right away.
 func SetEmailNotification(sender, recipient map[string]string, subjPrefix string) {
+	if err := checkSMTPSender(sender); err != nil {
+		ERROR("diag", "Email sender incomplete, SOS emails won't be sent", "err", err)
+	}
 
-	_emailNotifier = &EmailNotifier{
+	setEmailNotifier(&EmailNotifier{
 		sender:        sender,
 		recipient:     recipient,
 		subjectPrefix: subjPrefix,
-	}
+	})
+
+	// Emails spooled by previous run
+	replaySpool()
 }
 
+// Sets email notification sent by sendProc, that receives
+// HTML body of the message. See SetEmailNotificationSender
+// for plain text version too.
 func SetEmailNotificationProc(sender, recipient map[string]string, subjPrefix string, sendProc func(sender, recipient map[string]string, subj, body string)) {
 
-	_emailNotifier = &EmailNotifier{
+	setEmailNotifier(&EmailNotifier{
 		sender:        sender,
 		recipient:     recipient,
 		subjectPrefix: subjPrefix,
 		sendProc:      sendProc,
-	}
+	})
+
+	// SOS spooled before notification was set up
+	replaySpool()
 }
 
-//------------------------------------------------------------
-//
-//------------------------------------------------------------
+// Sets email notification sent by send func, that receives
+// both plain text and HTML versions of the message, ie to send
+// them as multipart/alternative. Failed sends are retried,
+// then spooled.
+func SetEmailNotificationSender(sender, recipient map[string]string, subjPrefix string, send func(msg *EmailMessage) error) {
 
-type Email struct {
-	Tag        string
-	Subject    string
-	ParamsHtml string
-	Params     []string
+	setEmailNotifier(&EmailNotifier{
+		sender:        sender,
+		recipient:     recipient,
+		subjectPrefix: subjPrefix,
+		send:          send,
+	})
+
+	// Emails spooled by previous run
+	replaySpool()
 }
 
-// Email template
-var _emailTpl = template.Must(template.New("deze333/diag/email").Parse(`
-<!DOCTYPE html>
-<html>
-<head>
-<meta charset="utf-8">
-</head>
-<body>
-<div style="font-family: monospace; font-size: 13px; color: maroon;">
-{{.Tag}}<br><strong>{{.Subject}}</strong>
-</div>
-<hr>
-<div style="font-family: monospace; font-size: 11px;">
-{{range .Params}}{{.}}<br>
-{{end}}
-</div>
-</body>
-</html>
-`))
+// Makes SOS emails go to send func instead of configured
+// sending, keeping sender, recipients and subject prefix.
+// Returned func restores previous notification.
+// Meant for tests, see diagtest.
+func RedirectEmailNotification(send func(msg *EmailMessage) error) (restore func()) {
+	_emailMu.Lock()
+	prev := _emailNotifier
+	n := &EmailNotifier{send: send}
+	if prev != nil {
+		n.sender = prev.sender
+		n.recipient = prev.recipient
+		n.subjectPrefix = prev.subjectPrefix
+	}
+	_emailNotifier = n
+	_emailMu.Unlock()
+
+	return func() {
+		setEmailNotifier(prev)
+	}
+}
+
+func setEmailNotifier(n *EmailNotifier) {
+	_emailMu.Lock()
+	defer _emailMu.Unlock()
+	_emailNotifier = n
+}
+
+// Returns current email notification, nil if not set.
+func emailNotifier() *EmailNotifier {
+	_emailMu.RLock()
+	defer _emailMu.RUnlock()
+	return _emailNotifier
+}
 
 //------------------------------------------------------------
 //
 //------------------------------------------------------------
 
-func notifyEmail(name, title string, args ...interface{}) {
-	if _emailNotifier == nil {
+func notifyEmail(rec *Record) {
+	if emailNotifier() == nil {
 		return
 	}
 
-	subj := "[" + _emailNotifier.subjectPrefix + "] " + name + " : " + title
-
-	e := Email{
-		Tag:     name,
-		Subject: title,
-		Params:  []string{},
+	// Throttled emails go to digest
+	if !_emailThrottle.admit(rec.Name, rec.Title, rec.Args) {
+		return
 	}
 
-	// Convert to strings
-	// Change \n to <br> in those who have it
-	ss := make([]string, len(args))
-	for i, v := range args {
-		s := fmt.Sprint(v)
-		if strings.Contains(s, "\n") {
-			ss[i] = strings.Replace(s, "\n", "<br>", -1)
-		} else {
-			ss[i] = s
-		}
+	data := newEmailData(rec)
+	msg, err := renderEmail(data)
+	if err != nil {
+		ERROR("diag", "Error generating SOS email via template. Email send aborted.", "err", err)
+		return
 	}
 
-	if len(ss) == 1 {
-		e.Params = append(e.Params, fmt.Sprint(ss[0]))
-	} else {
-		for i := 0; i+1 < len(ss); i += 2 {
-			key := ss[i]
-			val := strings.Replace(ss[i+1], "\n", "<br>", -1)
-			e.Params = append(e.Params, fmt.Sprintf("<strong>%s</strong> = %s<br>", key, val))
-		}
-	}
+	sendEmail(msg, recipientsFor(rec.Name))
+}
 
-	var err error
-	var msg bytes.Buffer
-	err = _emailTpl.Execute(&msg, e)
-	if err != nil {
-		ERROR("diag", "Error generating SOS email via template. Email send aborted.", "err", err)
+// Sends email asynchronously via sender func, send proc or SMTP.
+// Sender func and send proc are called once per recipient.
+func sendEmail(msg *EmailMessage, recipients []Recipient) {
+	en := emailNotifier()
+	if en == nil {
 		return
 	}
 
 	// Async send email
-	if _emailNotifier.sendProc != nil {
+	if send := en.send; send != nil {
+
+		// Via sender func, with retry
+		for _, r := range recipients {
+			m := *msg
+			m.Sender = en.sender
+			m.Recipient = r.toMap()
+			to := []Recipient{r}
+			goNotify(func() error {
+				err := retry(func() error { return send(&m) })
+				if err != nil {
+					ERROR("diag", "Error sending email. Email spooled.", "err", err)
+					spool(&spoolEntry{Email: newSpoolEmail(&m, to)})
+				}
+				return err
+			})
+		}
+
+	} else if sendProc := en.sendProc; sendProc != nil {
 
 		// Via send proc
-		go _emailNotifier.sendProc(
-			_emailNotifier.sender, _emailNotifier.recipient,
-			subj, msg.String())
+		sender := en.sender
+		for _, r := range recipients {
+			recipient := r.toMap()
+			goNotify(func() error {
+				sendProc(sender, recipient, msg.Subject, msg.HTML)
+				return nil
+			})
+		}
 
 	} else {
 
-		// Via SMTP
-		email := m8l.NewEmail(subj, &msg)
-		email.SetSender(_emailNotifier.sender)
-		email.SetReplyTo(_emailNotifier.recipient["identity"], _emailNotifier.recipient["email"])
-		email.AddTo(_emailNotifier.recipient["identity"], _emailNotifier.recipient["email"])
-		if err = email.Validate(); err != nil {
-			ERROR("diag", "Error validating email. Email send aborted.", "err", err)
-			return
+		// Via SMTP: To and Cc recipients share one email,
+		// every Bcc recipient gets a separate copy
+		var to []Recipient
+		for _, r := range recipients {
+			if r.isBcc() {
+				sendSMTP(en, msg, []Recipient{r})
+			} else {
+				to = append(to, r)
+			}
+		}
+		if len(to) != 0 {
+			sendSMTP(en, msg, to)
 		}
-		if err = email.SendAsync(); err != nil {
-			ERROR("diag", "Error sending email. Email send aborted.", "err", err)
-			return
+	}
+}
+
+// Sends email via SMTP in the background.
+// Failed email is retried, then spooled.
+func sendSMTP(en *EmailNotifier, msg *EmailMessage, to []Recipient) {
+	email, err := newSMTPEmail(en.sender, msg, to)
+	if err != nil {
+		ERROR("diag", "Error validating email. Email send aborted.", "err", err)
+		return
+	}
+	goNotify(func() error {
+		err := retry(email.Send)
+		if err != nil {
+			ERROR("diag", "Error sending email. Email spooled.", "err", err)
+			spool(&spoolEntry{Email: newSpoolEmail(msg, to)})
 		}
+		return err
+	})
+}
+
+// Runs send in the background as tracked notification
+// and counts it as sent or failed.
+func goNotify(send func() error) {
+	goTracked(func() {
+		countNotify(send())
+	})
+}
+
+// Runs fn in the background, WaitNotifications waits for it.
+func goTracked(fn func()) {
+	_notifying.Lock()
+	if _notifying.pending == 0 {
+		_notifying.idle = make(chan struct{})
+	}
+	_notifying.pending++
+	_notifying.Unlock()
+
+	go func() {
+		defer func() {
+			_notifying.Lock()
+			_notifying.pending--
+			if _notifying.pending == 0 {
+				close(_notifying.idle)
+			}
+			_notifying.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// Waits until notifications being sent, including retries,
+// are done or ctx is done. Notifications started while
+// waiting are waited for too.
+func WaitNotifications(ctx context.Context) error {
+	_notifying.Lock()
+	if _notifying.pending == 0 {
+		_notifying.Unlock()
+		return nil
+	}
+	idle := _notifying.idle
+	_notifying.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("diag: pending notifications not sent: %w", ctx.Err())
 	}
 }
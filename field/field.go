@@ -0,0 +1,321 @@
+// Typed log fields that avoid key/value mis-pairing
+// and interface boxing of common value types
+package field
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/deze333/diag/util"
+)
+
+// Type of value held by Field
+type Kind uint8
+
+const (
+	KindAny Kind = iota
+	KindString
+	KindInt
+	KindUint
+	KindFloat
+	KindBool
+	KindDuration
+	KindTime
+	KindError
+)
+
+// Key and typed value.
+// Numbers, bools, durations and times are held in Int,
+// strings in Str, everything else in Any.
+type Field struct {
+	Key  string
+	Kind Kind
+	Int  int64
+	Str  string
+	Any  interface{}
+}
+
+//------------------------------------------------------------
+// Constructors
+//------------------------------------------------------------
+
+func String(k, v string) Field {
+	return Field{Key: k, Kind: KindString, Str: v}
+}
+
+func Int(k string, v int) Field {
+	return Field{Key: k, Kind: KindInt, Int: int64(v)}
+}
+
+func Int64(k string, v int64) Field {
+	return Field{Key: k, Kind: KindInt, Int: v}
+}
+
+func Uint(k string, v uint64) Field {
+	return Field{Key: k, Kind: KindUint, Int: int64(v)}
+}
+
+func Float(k string, v float64) Field {
+	return Field{Key: k, Kind: KindFloat, Int: int64(math.Float64bits(v))}
+}
+
+func Bool(k string, v bool) Field {
+	f := Field{Key: k, Kind: KindBool}
+	if v {
+		f.Int = 1
+	}
+	return f
+}
+
+func Dur(k string, v time.Duration) Field {
+	return Field{Key: k, Kind: KindDuration, Int: int64(v)}
+}
+
+// Time field keeps location so it is formatted as given
+func Time(k string, v time.Time) Field {
+	return Field{Key: k, Kind: KindTime, Int: v.UnixNano(), Any: v.Location()}
+}
+
+// Error field under "err" key
+func Err(err error) Field {
+	return Field{Key: "err", Kind: KindError, Any: err}
+}
+
+func Any(k string, v interface{}) Field {
+	return Field{Key: k, Kind: KindAny, Any: v}
+}
+
+//------------------------------------------------------------
+// Values
+//------------------------------------------------------------
+
+// Returns value with its original type.
+func (f Field) Value() interface{} {
+	switch f.Kind {
+	case KindString:
+		return f.Str
+	case KindInt:
+		return f.Int
+	case KindUint:
+		return uint64(f.Int)
+	case KindFloat:
+		return math.Float64frombits(uint64(f.Int))
+	case KindBool:
+		return f.Int == 1
+	case KindDuration:
+		return time.Duration(f.Int)
+	case KindTime:
+		return f.time()
+	}
+	return f.Any
+}
+
+// Appends value as text to b.
+func (f Field) AppendValue(b []byte) []byte {
+	switch f.Kind {
+	case KindString:
+		return append(b, f.Str...)
+	case KindInt:
+		return strconv.AppendInt(b, f.Int, 10)
+	case KindUint:
+		return strconv.AppendUint(b, uint64(f.Int), 10)
+	case KindFloat:
+		return strconv.AppendFloat(b, math.Float64frombits(uint64(f.Int)), 'g', -1, 64)
+	case KindBool:
+		return strconv.AppendBool(b, f.Int == 1)
+	case KindDuration:
+		return append(b, time.Duration(f.Int).String()...)
+	case KindTime:
+		return f.time().AppendFormat(b, time.RFC3339Nano)
+	case KindError:
+		if f.Any == nil {
+			return append(b, "<nil>"...)
+		}
+		return append(b, f.Any.(error).Error()...)
+	}
+	return util.AppendValue(b, f.Any)
+}
+
+// Returns value as text.
+func (f Field) ValueString() string {
+	if f.Kind == KindString {
+		return f.Str
+	}
+	return string(f.AppendValue(nil))
+}
+
+// Tells if field is an empty "", "" pair used as visual separator.
+func (f Field) IsSeparator() bool {
+	return f.Key == "" && f.Kind == KindAny && util.IsEmpty(f.Any)
+}
+
+func (f Field) time() time.Time {
+	t := time.Unix(0, f.Int)
+	if loc, ok := f.Any.(*time.Location); ok {
+		t = t.In(loc)
+	}
+	return t
+}
+
+//------------------------------------------------------------
+// Arguments
+//------------------------------------------------------------
+
+// Tells if arguments are a single untyped value
+// that is output without a key. Single error that wraps
+// other errors is not, it is iterated as err field.
+func IsSingle(args []interface{}) bool {
+	if len(args) != 1 {
+		return false
+	}
+	switch a := args[0].(type) {
+	case Field:
+		return false
+	case error:
+		return util.ErrorCauses(a) == nil
+	}
+	return true
+}
+
+// Walks log arguments as fields.
+// Field arguments take one position, untyped key and value
+// take two. A trailing key without value is dropped,
+// except single error argument that is keyed err.
+// Errors that wrap other errors are expanded into nested
+// fields, see ErrorFields. Fields are read from args on demand,
+// not kept in iterator, so that args don't escape to heap.
+type Iterator struct {
+	args    []interface{}
+	pos     int
+	pending []Field
+}
+
+func Iterate(args []interface{}) Iterator {
+	return Iterator{args: args}
+}
+
+// Returns next field and true, or false when done.
+func (it *Iterator) Next() (Field, bool) {
+	if len(it.pending) != 0 {
+		f := it.pending[0]
+		it.pending = it.pending[1:]
+		return f, true
+	}
+	if !it.More() {
+		return Field{}, false
+	}
+
+	a := it.args[it.pos]
+	if f, ok := a.(Field); ok {
+		it.pos++
+		return it.expand(f), true
+	}
+
+	if it.pos+1 >= len(it.args) {
+		it.pos = len(it.args)
+		return it.expand(Err(a.(error))), true
+	}
+
+	v := it.args[it.pos+1]
+	it.pos += 2
+	return it.expand(Field{Key: keyString(a), Kind: KindAny, Any: v}), true
+}
+
+// Tells if there are fields left.
+func (it *Iterator) More() bool {
+	if len(it.pending) != 0 {
+		return true
+	}
+	if it.pos >= len(it.args) {
+		return false
+	}
+	if it.pos+1 < len(it.args) {
+		return true
+	}
+
+	// Trailing argument
+	a := it.args[it.pos]
+	if _, ok := a.(Field); ok {
+		return true
+	}
+	_, ok := a.(error)
+	return ok && len(it.args) == 1
+}
+
+// Returns trailing key without value and true, if args end
+// with one. Positions are counted as Iterator does, so Field
+// arguments take one and untyped key and value two.
+func Trailing(args []interface{}) (interface{}, bool) {
+	pos := 0
+	for pos < len(args)-1 {
+		if _, ok := args[pos].(Field); ok {
+			pos++
+		} else {
+			pos += 2
+		}
+	}
+	if pos != len(args)-1 {
+		return nil, false
+	}
+	if _, ok := args[pos].(Field); ok {
+		return nil, false
+	}
+	return args[pos], true
+}
+
+// Returns first field of error wrapping other errors
+// and keeps the rest pending.
+func (it *Iterator) expand(f Field) Field {
+	if err, ok := f.Any.(error); ok && util.ErrorCauses(err) != nil {
+		fields := ErrorFields(f.Key, err)
+		f, it.pending = fields[0], fields[1:]
+	}
+	return f
+}
+
+func keyString(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+//------------------------------------------------------------
+// Errors
+//------------------------------------------------------------
+
+// Limits fields of single error chain
+const maxErrorFields = 32
+
+// Returns error and errors it wraps as text fields:
+//
+//	err = query: conn: timeout
+//	err.cause = conn: timeout
+//	err.cause.cause = timeout
+//
+// Errors joined with errors.Join are keyed err.0, err.1 and so on.
+func ErrorFields(key string, err error) []Field {
+	var fields []Field
+	var walk func(key string, err error)
+	walk = func(key string, err error) {
+		if len(fields) == maxErrorFields {
+			return
+		}
+		fields = append(fields, String(key, err.Error()))
+
+		causes := util.ErrorCauses(err)
+		if len(causes) == 1 {
+			walk(key+".cause", causes[0])
+			return
+		}
+		for i, cause := range causes {
+			if cause != nil {
+				walk(key+"."+strconv.Itoa(i), cause)
+			}
+		}
+	}
+	walk(key, err)
+	return fields
+}
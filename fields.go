@@ -0,0 +1,55 @@
+package diag
+
+import (
+	"time"
+
+	"github.com/deze333/diag/field"
+)
+
+//------------------------------------------------------------
+// Typed fields
+//------------------------------------------------------------
+
+// Typed field that can be passed among log arguments
+// in place of untyped key and value pair.
+type Field = field.Field
+
+func String(k, v string) Field {
+	return field.String(k, v)
+}
+
+func Int(k string, v int) Field {
+	return field.Int(k, v)
+}
+
+func Int64(k string, v int64) Field {
+	return field.Int64(k, v)
+}
+
+func Uint(k string, v uint64) Field {
+	return field.Uint(k, v)
+}
+
+func Float(k string, v float64) Field {
+	return field.Float(k, v)
+}
+
+func Bool(k string, v bool) Field {
+	return field.Bool(k, v)
+}
+
+func Dur(k string, v time.Duration) Field {
+	return field.Dur(k, v)
+}
+
+func Time(k string, v time.Time) Field {
+	return field.Time(k, v)
+}
+
+func Err(err error) Field {
+	return field.Err(err)
+}
+
+func Any(k string, v interface{}) Field {
+	return field.Any(k, v)
+}
@@ -0,0 +1,80 @@
+package diag
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/deze333/diag/util"
+)
+
+//------------------------------------------------------------
+// Goroutine dumps
+//------------------------------------------------------------
+
+// Writes stacks of all goroutines to all outputs as WARNING,
+// regardless of output level. Goroutines with identical stacks
+// are grouped, largest groups first. Diag's own frames are left
+// out of the dumping goroutine. In JSON output groups are array
+// of objects with count, state and frames:
+//
+//	goroutines = 42
+//	groups =
+//	37 @ [chan receive]
+//	main.worker()...
+func DumpGoroutines(name, title string) {
+	groups, total := util.Goroutines()
+	for i, g := range groups {
+		if g.State == "running" && dumping(g.Stack) {
+			groups[i].Stack = g.Stack.Without(diagPkg, utilPkg)
+		}
+	}
+
+	output(&Record{
+		Level:  LevelWarning,
+		Time:   time.Now(),
+		Name:   name,
+		Title:  title,
+		always: true,
+	}, []interface{}{"goroutines", total, "groups", groups})
+}
+
+// Tells if stack is that of goroutine calling DumpGoroutines
+func dumping(st util.StackTrace) bool {
+	for _, f := range st {
+		if f.Function == diagPkg+"DumpGoroutines" {
+			return true
+		}
+	}
+	return false
+}
+
+// Dumps goroutines whenever process receives any of signals,
+// ie syscall.SIGUSR1 or syscall.SIGQUIT. Catching SIGQUIT
+// replaces its default behaviour of dumping and exiting.
+// Returned func stops listening.
+func DumpGoroutinesOnSignal(sig ...os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sig...)
+
+	go func() {
+		for {
+			select {
+			case s := <-c:
+				DumpGoroutines("diag", "Goroutines on "+s.String())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// JSON logging produces one JSON object per line
+package jsonl
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/deze333/diag/field"
+)
+
+// Appends record as JSON object to b:
+//
+//	{"time":"...","level":"DEBUG","name":"db","title":"query","fields":{"rows":10}}
+//
+// Single untyped argument is output as "arg".
+func Append(b []byte, t time.Time, level, name, title string, args []interface{}) []byte {
+	b = append(b, `{"time":"`...)
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, `","level":`...)
+	b = AppendString(b, level)
+	if name != "" {
+		b = append(b, `,"name":`...)
+		b = AppendString(b, name)
+	}
+	b = append(b, `,"title":`...)
+	b = AppendString(b, title)
+
+	if field.IsSingle(args) {
+		b = append(b, `,"arg":`...)
+		b = AppendValue(b, field.Any("", args[0]))
+		return append(b, '}')
+	}
+
+	first := true
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		if f.IsSeparator() {
+			continue
+		}
+		if first {
+			b = append(b, `,"fields":{`...)
+			first = false
+		} else {
+			b = append(b, ',')
+		}
+		b = AppendString(b, f.Key)
+		b = append(b, ':')
+		b = AppendValue(b, f)
+	}
+	if !first {
+		b = append(b, '}')
+	}
+	return append(b, '}')
+}
+
+// Appends field value as JSON keeping its type.
+// Durations are output as text, same as in other formats.
+func AppendValue(b []byte, f field.Field) []byte {
+	switch f.Kind {
+	case field.KindString:
+		return AppendString(b, f.Str)
+	case field.KindInt:
+		return strconv.AppendInt(b, f.Int, 10)
+	case field.KindUint:
+		return strconv.AppendUint(b, uint64(f.Int), 10)
+	case field.KindFloat:
+		v := math.Float64frombits(uint64(f.Int))
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return AppendString(b, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strconv.AppendFloat(b, v, 'g', -1, 64)
+	case field.KindBool:
+		return strconv.AppendBool(b, f.Int == 1)
+	case field.KindDuration, field.KindTime, field.KindError:
+		return AppendString(b, f.ValueString())
+	}
+
+	switch v := f.Any.(type) {
+	case string:
+		return AppendString(b, v)
+	case time.Duration:
+		return AppendString(b, v.String())
+	case error:
+		return AppendString(b, v.Error())
+	case nil:
+		return append(b, "null"...)
+	}
+
+	data, err := json.Marshal(f.Any)
+	if err != nil {
+		return AppendString(b, f.ValueString())
+	}
+	return append(b, data...)
+}
+
+// Appends s as JSON string.
+func AppendString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, '\\', 'n')
+			case c == '\r':
+				b = append(b, '\\', 'r')
+			case c == '\t':
+				b = append(b, '\\', 't')
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `�`...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
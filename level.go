@@ -0,0 +1,98 @@
+package diag
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------
+// Levels
+//------------------------------------------------------------
+
+// Severity of a log record.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelNote
+	LevelWarning
+	LevelError
+	LevelSOS
+)
+
+var _levelNames = []string{"DEBUG", "NOTE", "WARNING", "ERROR", "SOS"}
+
+var (
+	// Records below this level aren't written to outputs
+	_outputLevel atomic.Int32
+
+	// Records below this level are discarded before formatting,
+	// the lowest level any output, recent buffer or subscriber takes
+	_minLevel atomic.Int32
+)
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(_levelNames) {
+		return "UNKNOWN"
+	}
+	return _levelNames[l]
+}
+
+// Returns level by its name, ie "WARNING".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range _levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelDebug, fmt.Errorf("diag: unknown level %q", s)
+}
+
+// Sets minimum level of records to output.
+// Records below it are discarded before any formatting.
+// SOS notifications are sent regardless.
+func SetLevel(level Level) {
+	_outputLevel.Store(int32(level))
+	updateMinLevel()
+}
+
+// Recalculates the lowest level of records to accept.
+func updateMinLevel() {
+	min := Level(_outputLevel.Load())
+	if r := _recent.Load(); r != nil && r.level < min {
+		min = r.level
+	}
+	if l, ok := subscribersLevel(); ok && l < min {
+		min = l
+	}
+	_minLevel.Store(int32(min))
+}
+
+// Tells if records of given level are output or kept.
+// Use to guard costly argument preparation.
+func Enabled(level Level) bool {
+	return int32(level) >= _minLevel.Load()
+}
+
+// Outputs message at given level.
+// NOTE level has no name, so name and title are joined.
+func logAt(level Level, name, title string, v ...interface{}) {
+	switch level {
+	case LevelDebug:
+		DEBUG(name, title, v...)
+	case LevelNote:
+		if name != "" {
+			title = name + ": " + title
+		}
+		NOTE(title, v...)
+	case LevelWarning:
+		WARNING(name, title, v...)
+	case LevelError:
+		ERROR(name, title, v...)
+	case LevelSOS:
+		SOS(name, title, v...)
+	default:
+		DEBUG(name, title, v...)
+	}
+}
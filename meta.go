@@ -0,0 +1,131 @@
+package diag
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/deze333/diag/field"
+)
+
+//------------------------------------------------------------
+// Process metadata
+//------------------------------------------------------------
+
+var (
+	_processOnce sync.Once
+	_host        string
+	_process     string
+	_build       []field.Field
+
+	_metaMu    sync.Mutex
+	_metaExtra []field.Field
+	_meta      atomic.Pointer[[]field.Field]
+
+	// Add metadata to every JSON record
+	_recordMeta atomic.Bool
+)
+
+// Adds user metadata, ie environment or region,
+// or replaces value of existing key.
+func SetMeta(k, v string) {
+	_metaMu.Lock()
+	defer _metaMu.Unlock()
+
+	extra := make([]field.Field, 0, len(_metaExtra)+1)
+	replaced := false
+	for _, f := range _metaExtra {
+		if f.Key == k {
+			f = field.String(k, v)
+			replaced = true
+		}
+		extra = append(extra, f)
+	}
+	if !replaced {
+		extra = append(extra, field.String(k, v))
+	}
+	_metaExtra = extra
+
+	meta := append(staticMeta(), extra...)
+	_meta.Store(&meta)
+}
+
+// Returns metadata attached to notifications: host, pid,
+// process, Go version, module version and VCS revision,
+// followed by user metadata. Must not be modified.
+func Metadata() []field.Field {
+	if m := _meta.Load(); m != nil {
+		return *m
+	}
+	_metaMu.Lock()
+	defer _metaMu.Unlock()
+	if m := _meta.Load(); m != nil {
+		return *m
+	}
+	meta := append(staticMeta(), _metaExtra...)
+	_meta.Store(&meta)
+	return meta
+}
+
+// Adds metadata to every record of JSON lines output
+// as "meta" object.
+func SetRecordMeta(enabled bool) {
+	_recordMeta.Store(enabled)
+}
+
+// Host, process and build info, collected once.
+func staticMeta() []field.Field {
+	host, process, pid := processInfo()
+	meta := []field.Field{
+		field.String("host", host),
+		field.Int("pid", pid),
+		field.String("process", process),
+	}
+	return append(meta, _build...)
+}
+
+// Returns host name, executable name and PID.
+func processInfo() (string, string, int) {
+	_processOnce.Do(func() {
+		_host, _ = os.Hostname()
+		if exe, err := os.Executable(); err == nil {
+			_process = filepath.Base(exe)
+		} else {
+			_process = filepath.Base(os.Args[0])
+		}
+		_build = buildInfo()
+	})
+	return _host, _process, os.Getpid()
+}
+
+// Go version, main module version and VCS details.
+func buildInfo() []field.Field {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return []field.Field{field.String("go", runtime.Version())}
+	}
+
+	fs := []field.Field{field.String("go", bi.GoVersion)}
+	if bi.Main.Path != "" {
+		fs = append(fs, field.String("module", bi.Main.Path))
+	}
+	if bi.Main.Version != "" {
+		fs = append(fs, field.String("version", bi.Main.Version))
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			fs = append(fs, field.String("revision", s.Value))
+		case "vcs.time":
+			fs = append(fs, field.String("revision time", s.Value))
+		case "vcs.modified":
+			if s.Value == "true" {
+				fs = append(fs, field.String("modified", s.Value))
+			}
+		}
+	}
+	return fs
+}
@@ -0,0 +1,217 @@
+package diag
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------
+// Metrics
+//------------------------------------------------------------
+
+// Snapshot of logging activity since process start.
+type Metrics struct {
+	// Records written by level, ie passing output level
+	Records map[string]uint64 `json:"records"`
+
+	// Records written by name, then level
+	Names map[string]map[string]uint64 `json:"names"`
+
+	// Bytes written by output: xterm, plain, json
+	Bytes map[string]uint64 `json:"bytes"`
+
+	// Records dropped by async queue
+	Dropped uint64 `json:"dropped"`
+
+	// Records dropped by slow subscribers
+	SubscriberDropped uint64 `json:"subscriber_dropped"`
+
+	// Records suppressed by sampling
+	Suppressed uint64 `json:"suppressed"`
+
+	// Log rotations
+	Rotations uint64 `json:"rotations"`
+
+	// Notifications delivered and failed after retries,
+	// including replays of spooled ones
+	NotifySent   uint64 `json:"notify_sent"`
+	NotifyFailed uint64 `json:"notify_failed"`
+}
+
+// Count per level
+type levelCounts [LevelSOS + 1]atomic.Uint64
+
+var _metrics struct {
+	records      levelCounts
+	names        sync.Map // name -> *levelCounts
+	xtermBytes   atomic.Uint64
+	plainBytes   atomic.Uint64
+	jsonBytes    atomic.Uint64
+	suppressed   atomic.Uint64
+	rotations    atomic.Uint64
+	notifySent   atomic.Uint64
+	notifyFailed atomic.Uint64
+}
+
+// Counts record by level and name.
+func countRecord(rec *Record) {
+	if rec.Level < 0 || rec.Level > LevelSOS {
+		return
+	}
+	_metrics.records[rec.Level].Add(1)
+
+	c, ok := _metrics.names.Load(rec.Name)
+	if !ok {
+		c, _ = _metrics.names.LoadOrStore(rec.Name, &levelCounts{})
+	}
+	c.(*levelCounts)[rec.Level].Add(1)
+}
+
+// Counts bytes written to outputs.
+func countBytes(e *entry) {
+	if n := len(e.xterm); n != 0 {
+		_metrics.xtermBytes.Add(uint64(n))
+	}
+	if n := len(e.plain); n != 0 {
+		_metrics.plainBytes.Add(uint64(n))
+	}
+	if n := len(e.json); n != 0 {
+		_metrics.jsonBytes.Add(uint64(n))
+	}
+}
+
+// Counts result of notification delivery.
+func countNotify(err error) {
+	if err == nil {
+		_metrics.notifySent.Add(1)
+	} else {
+		_metrics.notifyFailed.Add(1)
+	}
+}
+
+// Returns snapshot of logging metrics.
+func ReadMetrics() Metrics {
+	m := Metrics{
+		Records: map[string]uint64{},
+		Names:   map[string]map[string]uint64{},
+		Bytes: map[string]uint64{
+			"xterm": _metrics.xtermBytes.Load(),
+			"plain": _metrics.plainBytes.Load(),
+			"json":  _metrics.jsonBytes.Load(),
+		},
+		Dropped:           Dropped(),
+		SubscriberDropped: _subsDropped.Load(),
+		Suppressed:        _metrics.suppressed.Load(),
+		Rotations:         _metrics.rotations.Load(),
+		NotifySent:        _metrics.notifySent.Load(),
+		NotifyFailed:      _metrics.notifyFailed.Load(),
+	}
+	for l := range _metrics.records {
+		m.Records[Level(l).String()] = _metrics.records[l].Load()
+	}
+	_metrics.names.Range(func(k, v interface{}) bool {
+		counts := map[string]uint64{}
+		for l := range v.(*levelCounts) {
+			if n := v.(*levelCounts)[l].Load(); n != 0 {
+				counts[Level(l).String()] = n
+			}
+		}
+		m.Names[k.(string)] = counts
+		return true
+	})
+	return m
+}
+
+var _expvarOnce sync.Once
+
+// Publishes metrics snapshot as "diag" expvar,
+// served by expvar handler at /debug/vars.
+func PublishExpvar() {
+	_expvarOnce.Do(func() {
+		expvar.Publish("diag", expvar.Func(func() interface{} {
+			return ReadMetrics()
+		}))
+	})
+}
+
+// Returns handler that serves metrics in Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(formatPrometheus(ReadMetrics()))
+	})
+}
+
+// Formats metrics in Prometheus text exposition format.
+func formatPrometheus(m Metrics) []byte {
+	var buf bytes.Buffer
+	metric := func(name, help string) {
+		buf.WriteString("# HELP " + name + " " + help + "\n")
+		buf.WriteString("# TYPE " + name + " counter\n")
+	}
+	sample := func(name string, v uint64, labels ...string) {
+		buf.WriteString(name)
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i == 0 {
+				buf.WriteByte('{')
+			} else {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(labels[i] + `="` + promEscape(labels[i+1]) + `"`)
+			if i+2 >= len(labels) {
+				buf.WriteByte('}')
+			}
+		}
+		buf.WriteString(" " + strconv.FormatUint(v, 10) + "\n")
+	}
+
+	metric("diag_records_total", "Records written by level and name.")
+	names := make([]string, 0, len(m.Names))
+	for name := range m.Names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for l := LevelDebug; l <= LevelSOS; l++ {
+			if n, ok := m.Names[name][l.String()]; ok {
+				sample("diag_records_total", n, "level", l.String(), "name", name)
+			}
+		}
+	}
+
+	metric("diag_written_bytes_total", "Bytes written by output.")
+	for _, out := range []string{"xterm", "plain", "json"} {
+		sample("diag_written_bytes_total", m.Bytes[out], "output", out)
+	}
+
+	metric("diag_dropped_total", "Records dropped by async queue.")
+	sample("diag_dropped_total", m.Dropped)
+
+	metric("diag_subscriber_dropped_total", "Records dropped by slow subscribers.")
+	sample("diag_subscriber_dropped_total", m.SubscriberDropped)
+
+	metric("diag_suppressed_total", "Records suppressed by sampling.")
+	sample("diag_suppressed_total", m.Suppressed)
+
+	metric("diag_rotations_total", "Log rotations.")
+	sample("diag_rotations_total", m.Rotations)
+
+	metric("diag_notifications_total", "SOS notifications by result.")
+	sample("diag_notifications_total", m.NotifySent, "result", "sent")
+	sample("diag_notifications_total", m.NotifyFailed, "result", "failed")
+
+	return buf.Bytes()
+}
+
+var _promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escapes Prometheus label value.
+func promEscape(s string) string {
+	return _promEscaper.Replace(s)
+}
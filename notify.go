@@ -0,0 +1,92 @@
+package diag
+
+import (
+	"sync"
+)
+
+//------------------------------------------------------------
+// Notifiers
+//------------------------------------------------------------
+
+// Receives SOS records to alert a human.
+// Notify is called in its own goroutine, so it may block.
+// Failed notification is retried, then spooled to disk.
+// Notifiers that implement fmt.Stringer are identified by
+// String when spooled notifications are replayed.
+type Notifier interface {
+	Notify(rec *Record) error
+}
+
+var (
+	_notifiersMu sync.RWMutex
+	_notifiers   []Notifier
+)
+
+// Adds notifier to receive every SOS in addition to email.
+// Notifiers are called in parallel.
+func AddNotifier(n Notifier) {
+	_notifiersMu.Lock()
+	defer _notifiersMu.Unlock()
+	_notifiers = append(_notifiers, n)
+
+	// Notifications spooled by previous run
+	replaySpool()
+}
+
+// Removes notifier previously added.
+func RemoveNotifier(n Notifier) {
+	_notifiersMu.Lock()
+	defer _notifiersMu.Unlock()
+	for i, v := range _notifiers {
+		if v == n {
+			_notifiers = append(_notifiers[:i:i], _notifiers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Tells if SOS goes anywhere but log, to email or a notifier.
+func notificationsSet() bool {
+	if emailNotifier() != nil {
+		return true
+	}
+	_notifiersMu.RLock()
+	defer _notifiersMu.RUnlock()
+	return len(_notifiers) != 0
+}
+
+// Sends SOS record to email and all notifiers.
+func notify(rec *Record) {
+	if rec.Caller == "" {
+		rec.Caller = externalCaller()
+	}
+	if rec.Meta == nil {
+		rec.Meta = Metadata()
+	}
+	if rec.Recent == nil {
+		rec.Recent = Recent()
+	}
+	notifyEmail(rec)
+
+	_notifiersMu.RLock()
+	ns := _notifiers
+	_notifiersMu.RUnlock()
+	if len(ns) == 0 {
+		return
+	}
+
+	c := rec.clone(rec.Args)
+	for _, n := range ns {
+		n := n
+		goNotify(func() error {
+			err := retry(func() error {
+				return n.Notify(c)
+			})
+			if err != nil {
+				ERROR("diag", "Error sending notification. Notification spooled.", "notifier", notifierKey(n), "err", err)
+				spool(&spoolEntry{Notifier: notifierKey(n), Record: c})
+			}
+			return err
+		})
+	}
+}
@@ -2,87 +2,103 @@
 package plain
 
 import (
-	"fmt"
 	"strings"
-    "time"
+	"time"
+
+	"github.com/deze333/diag/field"
+	"github.com/deze333/diag/util"
 )
 
 const (
-    sep = "------------------------------------------------------------"
-    sepSos = "============================================================"
+	sep    = "------------------------------------------------------------"
+	sepSos = "============================================================"
 )
 
 func DEBUG(t time.Time, name, title string, args ...interface{}) string {
-	out := []string{
-        sep,
-        t.Format(time.ANSIC),
-    }
-
-	out = append(out, fmt.Sprintf("\"%s\"\n%s", name, title))
-
-    if len(args) == 1 {
-        out = append(out, fmt.Sprintf(" %v", args[0]))
-    } else {
-        for i := 0; i + 1 < len(args); i += 2 {
-            out = append(out, fmt.Sprintf("    * %s = %s", args[i], args[i+1]))
-        }
-    }
-
-	return strings.Join(out, "\n")
+	return string(AppendDEBUG(nil, t, name, title, args))
 }
 
 func NOTE(t time.Time, msg string, args ...interface{}) string {
-	out := []string{
-        sep,
-        t.Format(time.ANSIC),
-    }
-    out = append(out, "\n")
-    out = append(out, fmt.Sprintf(">>> %s:\n", msg))
-
-    if len(args) == 1 {
-        out = append(out, fmt.Sprintf(" %v", args[0]))
-    } else {
-        for i := 0; i + 1 < len(args); i += 2 {
-            out = append(out, fmt.Sprintf("* %s = %s\n", args[i], args[i+1]))
-        }
-    }
-
-	return strings.Join(out, "")
+	return string(AppendNOTE(nil, t, msg, args))
 }
 
 func WARNING(t time.Time, name, title string, args ...interface{}) string {
-	out := []string{
-        sepSos,
-        t.Format(time.ANSIC),
-    }
+	return string(AppendWARNING(nil, t, name, title, args))
+}
 
-    out = append(out, fmt.Sprintf("\"%s\"\n!!! WARNING: %s", name, title))
+func ERROR(t time.Time, name, title string, args ...interface{}) string {
+	return string(AppendERROR(nil, t, name, title, args))
+}
 
-    if len(args) == 1 {
-        out = append(out, fmt.Sprintf(" %v", args[0]))
-    } else {
-        for i := 0; i + 1 < len(args); i += 2 {
-            out = append(out, fmt.Sprintf("    * %s = %s", args[i], args[i+1]))
-        }
-    }
+// Appends DEBUG output to b
+func AppendDEBUG(b []byte, t time.Time, name, title string, args []interface{}) []byte {
+	return appendRecord(b, sep, t, name, "", title, args)
+}
 
-	return strings.Join(out, "\n")
+// Appends WARNING output to b
+func AppendWARNING(b []byte, t time.Time, name, title string, args []interface{}) []byte {
+	return appendRecord(b, sepSos, t, name, "!!! WARNING: ", title, args)
 }
-func ERROR(t time.Time, name, title string, args ...interface{}) string {
-	out := []string{
-        sepSos,
-        t.Format(time.ANSIC),
-    }
 
-    out = append(out, fmt.Sprintf("\"%s\"\n!!! ERROR: %s", name, title))
+// Appends ERROR output to b
+func AppendERROR(b []byte, t time.Time, name, title string, args []interface{}) []byte {
+	return appendRecord(b, sepSos, t, name, "!!! ERROR: ", title, args)
+}
 
-    if len(args) == 1 {
-        out = append(out, fmt.Sprintf(" %v", args[0]))
-    } else {
-        for i := 0; i + 1 < len(args); i += 2 {
-            out = append(out, fmt.Sprintf("    * %s = %s", args[i], args[i+1]))
-        }
-    }
+// Appends NOTE output to b
+func AppendNOTE(b []byte, t time.Time, msg string, args []interface{}) []byte {
+	b = append(b, sep...)
+	b = t.AppendFormat(b, time.ANSIC)
+	b = append(b, "\n>>> "...)
+	b = append(b, msg...)
+	b = append(b, ":\n"...)
+
+	if field.IsSingle(args) {
+		b = append(b, ' ')
+		return util.AppendValue(b, args[0])
+	}
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		b = append(b, "* "...)
+		b = append(b, f.Key...)
+		b = append(b, " = "...)
+		b = f.AppendValue(b)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// Separator, time, name and title followed by argument per line
+func appendRecord(b []byte, separator string, t time.Time, name, mark, title string, args []interface{}) []byte {
+	b = append(b, separator...)
+	b = append(b, '\n')
+	b = t.AppendFormat(b, time.ANSIC)
+	b = append(b, "\n\""...)
+	b = append(b, name...)
+	b = append(b, "\"\n"...)
+	b = append(b, mark...)
+	b = append(b, title...)
+
+	if field.IsSingle(args) {
+		b = append(b, "\n "...)
+		return util.AppendValue(b, args[0])
+	}
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		b = append(b, "\n    * "...)
+		b = append(b, f.Key...)
+		b = append(b, " = "...)
+		b = f.AppendValue(b)
+	}
+	return b
+}
 
-	return strings.Join(out, "\n")
+// Closing record written when log is shut down
+func FOOTER(t time.Time) string {
+	return strings.Join([]string{
+		sepSos,
+		t.Format(time.ANSIC),
+		"=== Log closed",
+		sepSos,
+	}, "\n")
 }
@@ -0,0 +1,75 @@
+package diag
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------
+// Recent records
+//------------------------------------------------------------
+
+// Ring buffer of last records
+type recentRing struct {
+	level Level
+
+	mu   sync.Mutex
+	recs []*Record
+	next int
+	full bool
+}
+
+var _recent atomic.Pointer[recentRing]
+
+// Keeps last size records of given level and above in memory,
+// including those below level set by SetLevel. They are attached
+// to every SOS notification as preceding events.
+// Size of 0 turns recent records off.
+func SetRecent(size int, level Level) {
+	if size <= 0 {
+		_recent.Store(nil)
+	} else {
+		_recent.Store(&recentRing{level: level, recs: make([]*Record, size)})
+	}
+	updateMinLevel()
+}
+
+// Returns recent records, oldest first.
+func Recent() []*Record {
+	r := _recent.Load()
+	if r == nil {
+		return nil
+	}
+	return r.snapshot()
+}
+
+// Adds copy of record to recent records.
+func addRecent(rec *Record, args []interface{}) {
+	r := _recent.Load()
+	if r == nil || rec.Level < r.level {
+		return
+	}
+
+	c := rec.clone(args)
+	c.Recent = nil
+	r.mu.Lock()
+	r.recs[r.next] = c
+	r.next++
+	if r.next == len(r.recs) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+func (r *recentRing) snapshot() []*Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]*Record(nil), r.recs[:r.next]...)
+	}
+	out := make([]*Record, 0, len(r.recs))
+	out = append(out, r.recs[r.next:]...)
+	return append(out, r.recs[:r.next]...)
+}
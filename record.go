@@ -0,0 +1,415 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deze333/diag/field"
+	"github.com/deze333/diag/jsonl"
+	"github.com/deze333/diag/plain"
+	"github.com/deze333/diag/util"
+	"github.com/deze333/diag/xterm"
+)
+
+//------------------------------------------------------------
+// Records
+//------------------------------------------------------------
+
+// Single log record as passed to outputs.
+type Record struct {
+	Level Level
+	Time  time.Time
+	Name  string
+	Title string
+	Args  []interface{}
+
+	// File and line of SOS call
+	Caller string
+
+	// Process metadata, set on SOS
+	Meta []field.Field
+
+	// Records preceding SOS, oldest first
+	Recent []*Record
+
+	// NOTE2 style
+	inverse bool
+
+	// Written regardless of output level
+	always bool
+}
+
+// Returns record as JSON object, same as in JSON lines output.
+// Caller, metadata and recent records, if any, are added as
+// "caller", "meta" and "recent". Value receiver, so records
+// received from Subscribe marshal the same.
+func (r Record) MarshalJSON() ([]byte, error) {
+	return appendRecordJSON(nil, &r, r.Args, r.Meta), nil
+}
+
+func appendRecordJSON(b []byte, r *Record, args []interface{}, meta []field.Field) []byte {
+	b = jsonl.Append(b, r.Time, r.Level.String(), r.Name, r.Title, args)
+	if r.Caller == "" && len(meta) == 0 && len(r.Recent) == 0 {
+		return b
+	}
+
+	// Reopen object
+	b = b[:len(b)-1]
+
+	if r.Caller != "" {
+		b = append(b, `,"caller":`...)
+		b = jsonl.AppendString(b, r.Caller)
+	}
+
+	if len(meta) != 0 {
+		b = append(b, `,"meta":{`...)
+		for i, f := range meta {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = jsonl.AppendString(b, f.Key)
+			b = append(b, ':')
+			b = jsonl.AppendValue(b, f)
+		}
+		b = append(b, '}')
+	}
+
+	if len(r.Recent) != 0 {
+		b = append(b, `,"recent":[`...)
+		for i, rr := range r.Recent {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendRecordJSON(b, rr, rr.Args, rr.Meta)
+		}
+		b = append(b, ']')
+	}
+
+	return append(b, '}')
+}
+
+// Returns record as single line of text:
+//
+//	15:04:05.000 DEBUG db : query, rows = 10
+func (r Record) String() string {
+	b := r.Time.AppendFormat(nil, "15:04:05.000")
+	b = append(b, ' ')
+	b = append(b, r.Level.String()...)
+	b = append(b, ' ')
+	if r.Name != "" {
+		b = append(b, r.Name...)
+		b = append(b, " : "...)
+	}
+	b = append(b, r.Title...)
+
+	if field.IsSingle(r.Args) {
+		b = append(b, ", "...)
+		b = util.AppendValue(b, r.Args[0])
+		return strings.Replace(string(b), "\n", " ", -1)
+	}
+	for it := field.Iterate(r.Args); it.More(); {
+		f, _ := it.Next()
+		if f.IsSeparator() {
+			continue
+		}
+		b = append(b, ", "...)
+		b = append(b, f.Key...)
+		b = append(b, " = "...)
+		b = f.AppendValue(b)
+	}
+	return strings.Replace(string(b), "\n", " ", -1)
+}
+
+// Restores record from JSON object produced by MarshalJSON.
+// Order of fields is kept. Numbers become int64 or float64 fields.
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var obj struct {
+		Time   time.Time       `json:"time"`
+		Level  string          `json:"level"`
+		Name   string          `json:"name"`
+		Title  string          `json:"title"`
+		Arg    json.RawMessage `json:"arg"`
+		Fields json.RawMessage `json:"fields"`
+		Caller string          `json:"caller"`
+		Meta   json.RawMessage `json:"meta"`
+		Recent []*Record       `json:"recent"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+
+	level, err := ParseLevel(obj.Level)
+	if err != nil {
+		return err
+	}
+	*r = Record{
+		Level:  level,
+		Time:   obj.Time,
+		Name:   obj.Name,
+		Title:  obj.Title,
+		Caller: obj.Caller,
+		Recent: obj.Recent,
+	}
+
+	if r.Meta, err = decodeJSONFields(obj.Meta); err != nil {
+		return err
+	}
+
+	// Single argument
+	if len(obj.Arg) != 0 {
+		v, err := decodeJSONValue(obj.Arg)
+		if err != nil {
+			return err
+		}
+		r.Args = []interface{}{v}
+		return nil
+	}
+
+	fields, err := decodeJSONFields(obj.Fields)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		r.Args = append(r.Args, f)
+	}
+	return nil
+}
+
+// Decodes JSON object into fields in original order.
+func decodeJSONFields(raw json.RawMessage) ([]field.Field, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var fields []field.Field
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		v, err := decodeJSONValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, jsonField(tok.(string), v))
+	}
+	return fields, nil
+}
+
+func decodeJSONValue(raw json.RawMessage) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := n.Float64()
+		return f, err
+	}
+	return v, nil
+}
+
+func jsonField(k string, v interface{}) field.Field {
+	switch v := v.(type) {
+	case string:
+		return field.String(k, v)
+	case int64:
+		return field.Int64(k, v)
+	case float64:
+		return field.Float(k, v)
+	case bool:
+		return field.Bool(k, v)
+	}
+	return field.Any(k, v)
+}
+
+// Returns copy of record with given arguments that is safe
+// to keep after log call returns. Arguments are converted to
+// fields, values of other than basic types are formatted as text.
+func (r *Record) clone(args []interface{}) *Record {
+	c := *r
+	if field.IsSingle(args) {
+		c.Args = []interface{}{freezeValue(args[0])}
+		return &c
+	}
+
+	c.Args = make([]interface{}, 0, len(args))
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		if f.Kind == field.KindAny {
+			f.Any = freezeValue(f.Any)
+		}
+		c.Args = append(c.Args, f)
+	}
+	return &c
+}
+
+// Keeps immutable values, formats others as text.
+func freezeValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64,
+		time.Duration, time.Time, error, util.StackTrace, util.GoroutineGroup, util.GoroutineGroups:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// Record formatted for each configured output.
+// Entries are pooled, so buffers are reused across calls.
+type entry struct {
+	level Level
+	xterm []byte
+	plain []byte
+	html  []byte
+	json  []byte
+}
+
+// Largest buffer returned to pool
+const maxPooledBuf = 64 * 1024
+
+var _entryPool = sync.Pool{
+	New: func() interface{} {
+		return &entry{}
+	},
+}
+
+// Sends record with args to outputs, directly or via async queue.
+// Args are passed beside record, rather than in rec.Args, so that
+// log call's variadic slice stays on caller's stack: records kept
+// after the call get a copy, see clone.
+func output(rec *Record, args []interface{}) {
+	addRecent(rec, args)
+	publish(rec, args)
+	if int32(rec.Level) < _outputLevel.Load() && !rec.always {
+		return
+	}
+	countRecord(rec)
+
+	e := format(rec, args)
+	if e == nil {
+		return
+	}
+	if enqueue(e) {
+		return
+	}
+	write(e)
+}
+
+// Formats record once for every configured output.
+// Formatting happens in caller's goroutine so that
+// arguments are never accessed after log call returns.
+// Returns nil if there is no output to write to.
+func format(rec *Record, args []interface{}) *entry {
+	o := loadOutputs()
+	if o.xterm == nil && o.plain == nil && o.json == nil {
+		return nil
+	}
+
+	e := newEntry(rec.Level)
+	if o.xterm != nil {
+		e.xterm = append(appendXterm(e.xterm, rec, args), '\n')
+	}
+	if o.plain != nil {
+		e.plain = append(appendPlain(e.plain, rec, args), '\n')
+	}
+	if o.json != nil {
+		if _recordMeta.Load() {
+			e.json = appendRecordJSON(e.json, rec, args, Metadata())
+		} else {
+			e.json = jsonl.Append(e.json, rec.Time, rec.Level.String(), rec.Name, rec.Title, args)
+		}
+		e.json = append(e.json, '\n')
+	}
+	return e
+}
+
+// Returns pooled entry with empty buffers.
+func newEntry(level Level) *entry {
+	e := _entryPool.Get().(*entry)
+	e.level = level
+	e.xterm = e.xterm[:0]
+	e.plain = e.plain[:0]
+	e.html = e.html[:0]
+	e.json = e.json[:0]
+	return e
+}
+
+// Writes formatted record to outputs
+// and returns entry to pool.
+func write(e *entry) {
+	countBytes(e)
+	_writeMu.Lock()
+	o := _outputs.Load()
+
+	// Xterm screen log
+	if len(e.xterm) != 0 && o.xterm != nil {
+		o.xterm.Write(e.xterm)
+	}
+
+	// Plain file output
+	if len(e.plain) != 0 && o.plain != nil {
+		o.plain.Write(e.plain)
+	}
+
+	// HTML file output
+	if len(e.html) != 0 && o.html != nil {
+		o.html.Write(e.html)
+	}
+
+	// JSON lines output
+	if len(e.json) != 0 && o.json != nil {
+		o.json.Write(e.json)
+	}
+
+	_writeMu.Unlock()
+
+	if cap(e.xterm) <= maxPooledBuf && cap(e.plain) <= maxPooledBuf && cap(e.html) <= maxPooledBuf && cap(e.json) <= maxPooledBuf {
+		_entryPool.Put(e)
+	}
+}
+
+func appendXterm(b []byte, rec *Record, args []interface{}) []byte {
+	switch rec.Level {
+	case LevelDebug:
+		return xterm.AppendDEBUG(b, rec.Time, rec.Name, rec.Title, args)
+	case LevelNote:
+		if rec.inverse {
+			return xterm.AppendNOTE2(b, rec.Time, rec.Title, args)
+		}
+		return xterm.AppendNOTE(b, rec.Time, rec.Title, args)
+	case LevelWarning:
+		return xterm.AppendWARNING(b, rec.Time, rec.Name, rec.Title, args)
+	default:
+		return xterm.AppendERROR(b, rec.Time, rec.Name, rec.Title, args)
+	}
+}
+
+func appendPlain(b []byte, rec *Record, args []interface{}) []byte {
+	switch rec.Level {
+	case LevelDebug:
+		return plain.AppendDEBUG(b, rec.Time, rec.Name, rec.Title, args)
+	case LevelNote:
+		return plain.AppendNOTE(b, rec.Time, rec.Title, args)
+	case LevelWarning:
+		return plain.AppendWARNING(b, rec.Time, rec.Name, rec.Title, args)
+	default:
+		return plain.AppendERROR(b, rec.Time, rec.Name, rec.Title, args)
+	}
+}
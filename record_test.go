@@ -0,0 +1,106 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Buffer safe to write from async writer and read in test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n"))
+}
+
+func TestJSONOutput(t *testing.T) {
+	restore := RedirectOutput(nil)
+	defer restore()
+	var buf syncBuffer
+	SetJSONOutput(&buf)
+	defer SetJSONOutput(nil)
+
+	WARNING("db", "slow query", "ms", 900)
+
+	lines := buf.Lines()
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines: %q", len(lines), lines)
+	}
+	var rec Record
+	if err := json.Unmarshal(lines[0], &rec); err != nil {
+		t.Fatalf("%v: %s", err, lines[0])
+	}
+	if rec.Level != LevelWarning || rec.Name != "db" || rec.Title != "slow query" {
+		t.Errorf("got %+v", rec)
+	}
+}
+
+// Switches JSON output while another goroutine keeps
+// logging, run with -race to check output swaps.
+func TestSetJSONOutputConcurrent(t *testing.T) {
+	restore := RedirectOutput(nil)
+	defer restore()
+	defer SetJSONOutput(nil)
+
+	started, stop := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				DEBUG("worker", "tick", "n", 1)
+			}
+		}
+	}()
+	<-started
+
+	var buf syncBuffer
+	for i := 0; i < 1000; i++ {
+		SetJSONOutput(&buf)
+		SetJSONOutput(nil)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// Records are delivered by value to subscribers
+func TestRecordValue(t *testing.T) {
+	restore := RedirectOutput(nil)
+	defer restore()
+	c, cancel := Subscribe(Filter{Name: "db"})
+	defer cancel()
+
+	WARNING("db", "slow query", "ms", 900)
+	rec := <-c
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, _ := json.Marshal(&rec)
+	if string(data) != string(ptr) || !bytes.Contains(data, []byte(`"level":"WARNING"`)) {
+		t.Errorf("got %s, want %s", data, ptr)
+	}
+	if s := fmt.Sprint(rec); s != rec.String() || !strings.HasSuffix(s, "WARNING db : slow query, ms = 900") {
+		t.Errorf("got %q", s)
+	}
+}
@@ -0,0 +1,73 @@
+package diag
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//------------------------------------------------------------
+// Panic recovery
+//------------------------------------------------------------
+
+// Recovers from panic and reports it as SOS with full stack trace.
+// Must be deferred directly:
+//
+//	defer diag.Recover("worker")
+func Recover(name string) {
+	if r := recover(); r != nil {
+		sosPanic(name, r)
+	}
+}
+
+// Same as Recover but panics again after reporting,
+// so the program crashes as it would without recovery.
+func RecoverRepanic(name string) {
+	if r := recover(); r != nil {
+		sosPanic(name, r)
+		panic(r)
+	}
+}
+
+// Launches fn in a new goroutine protected by Recover.
+func Go(name string, fn func()) {
+	go func() {
+		defer Recover(name)
+		fn()
+	}()
+}
+
+// HTTP middleware that recovers from panics in h.
+// Panic is reported as SOS together with request details
+// and client receives 500 Internal Server Error.
+func RecoverHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// Deliberate abort of response, let net/http handle it
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			sosPanic(name, p,
+				"method", r.Method,
+				"url", r.URL.String(),
+				"remote", r.RemoteAddr,
+				"user agent", r.UserAgent())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Reports recovered panic value with stack trace.
+func sosPanic(name string, p interface{}, v ...interface{}) {
+	title := fmt.Sprint("Panic: ", p)
+	if !sampleSOS(name, title) {
+		return
+	}
+	v = append(v, "panic", p, "stack", callerStack())
+	sos(&Record{Level: LevelSOS, Time: time.Now(), Name: name, Title: title, Args: v})
+}
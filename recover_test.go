@@ -0,0 +1,41 @@
+package diag
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecoverSOS(t *testing.T) {
+	restore := RedirectOutput(nil)
+	defer restore()
+	defer ResetThrottling()()
+	c, cancel := Subscribe(Filter{Level: LevelSOS})
+	defer cancel()
+	n := &recordNotifier{}
+	AddNotifier(n)
+	defer RemoveNotifier(n)
+
+	func() {
+		defer Recover("worker")
+		panic("boom")
+	}()
+
+	select {
+	case rec := <-c:
+		if rec.Level != LevelSOS || rec.Name != "worker" || rec.Title != "Panic: boom" {
+			t.Errorf("got %s", rec.String())
+		}
+	default:
+		t.Error("panic not published as SOS")
+	}
+
+	ctx, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	if err := WaitNotifications(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if recs := n.records(); len(recs) != 1 || recs[0].Level != LevelSOS {
+		t.Errorf("notified %v", recs)
+	}
+}
@@ -0,0 +1,127 @@
+package diag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+)
+
+//------------------------------------------------------------
+// SOS email recipients and routing
+//------------------------------------------------------------
+
+// Email recipient. Kind is "to", "cc" or "bcc", empty means "to".
+type Recipient struct {
+	Identity string `json:"identity"`
+	Email    string `json:"email"`
+	Kind     string `json:"kind,omitempty"`
+
+	// Recipient map given to SetEmailNotification
+	raw map[string]string
+}
+
+// Sends SOS whose name matches pattern to recipients.
+// Pattern syntax is that of path.Match, ie "payments*".
+// Empty pattern matches any name.
+type EmailRoute struct {
+	Pattern    string      `json:"pattern"`
+	Recipients []Recipient `json:"recipients"`
+}
+
+var (
+	_emailRoutesMu sync.RWMutex
+	_emailRoutes   []EmailRoute
+)
+
+// Sets routing rules for SOS emails. Rules are checked in
+// order and the first matching one wins. If none matches,
+// email goes to recipient given to SetEmailNotification.
+func SetEmailRoutes(routes []EmailRoute) error {
+	for _, r := range routes {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("diag: bad email route pattern %q: %w", r.Pattern, err)
+		}
+		for _, rcpt := range r.Recipients {
+			switch strings.ToLower(rcpt.Kind) {
+			case "", "to", "cc", "bcc":
+			default:
+				return fmt.Errorf("diag: bad recipient kind %q for %s", rcpt.Kind, rcpt.Email)
+			}
+		}
+	}
+
+	_emailRoutesMu.Lock()
+	defer _emailRoutesMu.Unlock()
+	_emailRoutes = routes
+	return nil
+}
+
+// Loads routing rules for SOS emails from JSON file:
+//
+//	[
+//	  {"pattern": "payments*", "recipients": [
+//	    {"identity": "Payments on-call", "email": "payments@example.com"},
+//	    {"identity": "Lead", "email": "lead@example.com", "kind": "cc"}]},
+//	  {"pattern": "*", "recipients": [
+//	    {"identity": "Platform", "email": "platform@example.com"}]}
+//	]
+func LoadEmailRoutes(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var routes []EmailRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return fmt.Errorf("diag: parsing email routes %s: %w", filename, err)
+	}
+	return SetEmailRoutes(routes)
+}
+
+// Returns recipients of SOS email with given name.
+func recipientsFor(name string) []Recipient {
+	_emailRoutesMu.RLock()
+	defer _emailRoutesMu.RUnlock()
+
+	for _, r := range _emailRoutes {
+		if r.Pattern == "" {
+			return r.Recipients
+		}
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			return r.Recipients
+		}
+	}
+
+	// Default recipient
+	var rcpt map[string]string
+	if en := emailNotifier(); en != nil {
+		rcpt = en.recipient
+	}
+	return []Recipient{{Identity: rcpt["identity"], Email: rcpt["email"], raw: rcpt}}
+}
+
+func (r Recipient) isCc() bool {
+	return strings.EqualFold(r.Kind, "cc")
+}
+
+func (r Recipient) isBcc() bool {
+	return strings.EqualFold(r.Kind, "bcc")
+}
+
+// Recipient as passed to send proc
+func (r Recipient) toMap() map[string]string {
+	if r.raw != nil {
+		return r.raw
+	}
+	kind := strings.ToLower(r.Kind)
+	if kind == "" {
+		kind = "to"
+	}
+	return map[string]string{
+		"identity": r.Identity,
+		"email":    r.Email,
+		"kind":     kind,
+	}
+}
@@ -0,0 +1,185 @@
+package diag
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//------------------------------------------------------------
+// Sampling of repeated records
+//------------------------------------------------------------
+
+// Records with same level, name and title are considered similar
+type sampleKey struct {
+	level Level
+	name  string
+	title string
+}
+
+type sampleCount struct {
+	seen       int
+	suppressed int
+}
+
+type sampler struct {
+	interval   time.Duration
+	first      int
+	thereafter int
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var _sampler atomic.Pointer[sampler]
+
+// Limits output of similar records, ie having same level,
+// name and title. Within every interval the first records
+// are output, then every thereafter-th one. Thereafter of 0
+// suppresses all the rest. When interval ends, a summary with
+// the number of suppressed records is output.
+// SOS records that are suppressed don't send notifications.
+// Zero interval turns sampling off.
+func SetSampling(interval time.Duration, first, thereafter int) {
+	if old := _sampler.Swap(nil); old != nil {
+		old.close()
+	}
+	if interval <= 0 {
+		return
+	}
+
+	s := &sampler{
+		interval:   interval,
+		first:      first,
+		thereafter: thereafter,
+		counts:     map[sampleKey]*sampleCount{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go s.run()
+	_sampler.Store(s)
+}
+
+// Tells if record passes level and sampling filters.
+func admit(level Level, name, title string) bool {
+	if !Enabled(level) {
+		return false
+	}
+	s := _sampler.Load()
+	if s == nil {
+		return true
+	}
+	return s.sample(sampleKey{level, name, title})
+}
+
+// Tells if SOS passes sampling filter.
+// Notification is sent even if SOS level is not output.
+func sampleSOS(name, title string) bool {
+	s := _sampler.Load()
+	if s == nil {
+		return true
+	}
+	return s.sample(sampleKey{LevelSOS, name, title})
+}
+
+// Counts record and tells if it must be output.
+func (s *sampler) sample(key sampleKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.counts[key]
+	if c == nil {
+		c = &sampleCount{}
+		s.counts[key] = c
+	}
+	c.seen++
+
+	if c.seen <= s.first {
+		return true
+	}
+	if s.thereafter > 0 && (c.seen-s.first)%s.thereafter == 0 {
+		return true
+	}
+	c.suppressed++
+	_metrics.suppressed.Add(1)
+	return false
+}
+
+// Clears counts, returned func restores them.
+func (s *sampler) reset() (restore func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := s.counts
+	s.counts = map[sampleKey]*sampleCount{}
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.counts = counts
+	}
+}
+
+// Closes windows on every interval
+func (s *sampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// Outputs summaries of suppressed records and starts new window.
+func (s *sampler) flush() {
+	s.mu.Lock()
+	counts := s.counts
+	s.counts = map[sampleKey]*sampleCount{}
+	s.mu.Unlock()
+
+	for key, c := range counts {
+		if c.suppressed == 0 {
+			continue
+		}
+		msg := "suppressed " + formatCount(c.suppressed) + " similar records"
+		output(&Record{
+			Level: key.level,
+			Time:  time.Now(),
+			Name:  key.name,
+			Title: key.title,
+		}, []interface{}{"sampling", msg})
+	}
+}
+
+func (s *sampler) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// Outputs summaries of currently suppressed records.
+func flushSampling() {
+	if s := _sampler.Load(); s != nil {
+		s.flush()
+	}
+}
+
+// Formats count with thousands separators: 4,213
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+package diag
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------
+// SMTP email
+//------------------------------------------------------------
+
+const (
+	smtpTimeout     = 30 * time.Second
+	smtpDefaultPort = "587"
+)
+
+// Email ready to be sent via SMTP.
+type smtpEmail struct {
+	host  string
+	port  string
+	auth  smtp.Auth
+	from  string
+	rcpts []string
+	msg   []byte
+}
+
+// Builds multipart/alternative email with text and HTML parts,
+// from sender given to SetEmailNotification.
+// Port 465 uses implicit TLS, others STARTTLS when offered.
+func newSMTPEmail(sender map[string]string, msg *EmailMessage, to []Recipient) (*smtpEmail, error) {
+	if err := checkSMTPSender(sender); err != nil {
+		return nil, err
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("diag: email has no recipients")
+	}
+
+	e := &smtpEmail{
+		host: sender["server"],
+		port: sender["port"],
+		from: sender["email"],
+	}
+	if e.port == "" {
+		e.port = smtpDefaultPort
+	}
+	if pw := sender["password"]; pw != "" {
+		e.auth = smtp.PlainAuth("", e.from, pw, e.host)
+	}
+
+	// Cc recipients are listed in Cc header,
+	// all others in To
+	var toList, ccList []string
+	for _, r := range to {
+		if r.Email == "" {
+			return nil, fmt.Errorf("diag: email recipient %q has no address", r.Identity)
+		}
+		e.rcpts = append(e.rcpts, r.Email)
+		if r.isCc() {
+			ccList = append(ccList, r.address())
+		} else {
+			toList = append(toList, r.address())
+		}
+	}
+
+	from := mail.Address{Name: sender["identity"], Address: e.from}
+	var b bytes.Buffer
+	writeHeader(&b, "From", from.String())
+	if len(toList) != 0 {
+		writeHeader(&b, "To", strings.Join(toList, ", "))
+	}
+	if len(ccList) != 0 {
+		writeHeader(&b, "Cc", strings.Join(ccList, ", "))
+	}
+	writeHeader(&b, "Reply-To", to[0].address())
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	writeHeader(&b, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&b, "MIME-Version", "1.0")
+	writeBody(&b, msg)
+	e.msg = b.Bytes()
+	return e, nil
+}
+
+// Reports sender keys that SMTP sending can't do without.
+func checkSMTPSender(sender map[string]string) error {
+	var missing []string
+	for _, key := range []string{"email", "server"} {
+		if sender[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("diag: email sender has no %s, expected keys are identity, email, server, port and password",
+			strings.Join(missing, " and "))
+	}
+	return nil
+}
+
+func writeHeader(b *bytes.Buffer, key, value string) {
+	b.WriteString(key + ": " + value + "\r\n")
+}
+
+// Writes Content-Type header and body with text and HTML parts.
+// Email without text has HTML part only.
+func writeBody(b *bytes.Buffer, msg *EmailMessage) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if msg.Text != "" {
+		writePart(mw, "text/plain; charset=utf-8", msg.Text)
+	}
+	writePart(mw, "text/html; charset=utf-8", msg.HTML)
+	mw.Close()
+
+	writeHeader(b, "Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	b.WriteString("\r\n")
+	b.Write(body.Bytes())
+}
+
+func writePart(mw *multipart.Writer, contentType, s string) {
+	w, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	qw := quotedprintable.NewWriter(w)
+	qw.Write([]byte(s))
+	qw.Close()
+}
+
+// Recipient as email header address
+func (r Recipient) address() string {
+	return (&mail.Address{Name: r.Identity, Address: r.Email}).String()
+}
+
+// Sends email, giving up after smtpTimeout.
+func (e *smtpEmail) Send() error {
+	addr := net.JoinHostPort(e.host, e.port)
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if e.port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: e.host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return err
+		}
+	}
+	if e.auth != nil {
+		if err := c.Auth(e.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.from); err != nil {
+		return err
+	}
+	for _, rcpt := range e.rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,168 @@
+package diag
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SMTP server that accepts every email without TLS
+// and records commands and message data.
+type smtpServer struct {
+	net.Listener
+	mu   sync.Mutex
+	cmds []string
+	data []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, line)
+		s.mu.Unlock()
+
+		switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+		case "EHLO":
+			tc.PrintfLine("250-localhost")
+			tc.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			tc.PrintfLine("235 Authenticated")
+		case "DATA":
+			tc.PrintfLine("354 Go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.data = append(s.data, string(data))
+			s.mu.Unlock()
+			tc.PrintfLine("250 Queued")
+		case "QUIT":
+			tc.PrintfLine("221 Bye")
+			return
+		default:
+			tc.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpServer) received() (cmds, data []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cmds, s.data
+}
+
+func TestSMTPEmail(t *testing.T) {
+	s := newSMTPServer(t)
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+
+	restore := RedirectOutput(io.Discard)
+	defer restore()
+	defer ResetThrottling()()
+	defer setEmailNotifier(emailNotifier())
+	SetEmailNotification(map[string]string{
+		"identity": "App",
+		"email":    "app@example.com",
+		"server":   "127.0.0.1",
+		"port":     port,
+		"password": "secret",
+	}, map[string]string{
+		"identity": "Ops",
+		"email":    "ops@example.com",
+	}, "app")
+
+	SOS("db", "connection lost", "host", "db1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitNotifications(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds, data := s.received()
+	if len(data) != 1 {
+		t.Fatalf("got %d emails, commands %q", len(data), cmds)
+	}
+	for _, want := range []string{"AUTH PLAIN ", "MAIL FROM:<app@example.com>", "RCPT TO:<ops@example.com>"} {
+		found := false
+		for _, cmd := range cmds {
+			found = found || strings.HasPrefix(cmd, want)
+		}
+		if !found {
+			t.Errorf("no %q in commands %q", want, cmds)
+		}
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(data[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := msg.Header.Get("From"); from != `"App" <app@example.com>` {
+		t.Errorf("From %q", from)
+	}
+	if to := msg.Header.Get("To"); to != `"Ops" <ops@example.com>` {
+		t.Errorf("To %q", to)
+	}
+	if subj, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); !strings.Contains(subj, "connection lost") {
+		t.Errorf("Subject %q", subj)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type %q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bufio.NewReader(msg.Body), params["boundary"])
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(p)
+		if !strings.Contains(string(body), "db1") {
+			t.Errorf("%s part doesn't contain argument: %s", p.Header.Get("Content-Type"), body)
+		}
+		types = append(types, p.Header.Get("Content-Type"))
+	}
+	if strings.Join(types, ", ") != "text/plain; charset=utf-8, text/html; charset=utf-8" {
+		t.Errorf("parts %q", types)
+	}
+}
@@ -0,0 +1,251 @@
+package diag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//------------------------------------------------------------
+// Retry and spool of failed notifications
+//------------------------------------------------------------
+
+const maxRetryBackoff = 5 * time.Minute
+
+var (
+	_retryMu       sync.RWMutex
+	_retryAttempts = 3
+	_retryBackoff  = time.Second
+
+	// Closed on Shutdown to spool pending retries at once
+	_retryAbort = make(chan struct{})
+
+	_spoolMu  sync.Mutex
+	_spoolSeq atomic.Uint64
+)
+
+// Notification that failed all delivery attempts.
+// Either notifier record or email is set. Record without
+// notifier is SOS logged before any notification was set up,
+// it is sent to email and all notifiers once there are some.
+type spoolEntry struct {
+	Notifier string      `json:"notifier,omitempty"`
+	Record   *Record     `json:"record,omitempty"`
+	Email    *spoolEmail `json:"email,omitempty"`
+}
+
+type spoolEmail struct {
+	Subject string      `json:"subject"`
+	Body    string      `json:"body"`
+	Text    string      `json:"text,omitempty"`
+	To      []Recipient `json:"to"`
+}
+
+func newSpoolEmail(msg *EmailMessage, to []Recipient) *spoolEmail {
+	return &spoolEmail{Subject: msg.Subject, Body: msg.HTML, Text: msg.Text, To: to}
+}
+
+// Sets how many times failed notifications are attempted,
+// doubling the delay after each failure starting with backoff.
+// When all attempts fail, notification is saved to spool
+// directory under log directory and sent again on next Start.
+func SetNotifyRetry(attempts int, backoff time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	_retryMu.Lock()
+	defer _retryMu.Unlock()
+	_retryAttempts = attempts
+	_retryBackoff = backoff
+}
+
+// Calls send until it succeeds or attempts run out.
+// Stops waiting between attempts on Shutdown.
+func retry(send func() error) (err error) {
+	_retryMu.RLock()
+	attempts, backoff, abort := _retryAttempts, _retryBackoff, _retryAbort
+	_retryMu.RUnlock()
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-abort:
+				return err
+			}
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+		if err = send(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Makes pending retries give up and spool at once.
+func abortRetries() {
+	_retryMu.Lock()
+	defer _retryMu.Unlock()
+	close(_retryAbort)
+	_retryAbort = make(chan struct{})
+}
+
+// Identifies notifier across restarts.
+func notifierKey(n Notifier) string {
+	if s, ok := n.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+// Saves failed notification to spool directory.
+func spool(e *spoolEntry) {
+	dir := ""
+	if _logger != nil {
+		dir = _logger.spoolDir
+	}
+	if dir == "" {
+		ERROR("diag", "Notification lost, no log directory to spool it to")
+		return
+	}
+
+	err := writeSpool(dir, e)
+	if err != nil {
+		ERROR("diag", "Notification lost, error writing spool", "err", err, "dir", dir)
+	}
+}
+
+func writeSpool(dir string, e *spoolEntry) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so replay never sees partial file
+	name := fmt.Sprintf("%d-%d.json", time.Now().UnixNano(), _spoolSeq.Add(1))
+	tmp := path.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0664); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, name))
+}
+
+// Sends spooled notifications in the background.
+// Notifications whose notifier isn't registered yet stay
+// in spool, so replay is repeated when notifiers are added.
+func replaySpool() {
+	if _logger == nil || _logger.spoolDir == "" {
+		return
+	}
+	dir := _logger.spoolDir
+
+	goTracked(func() {
+		_spoolMu.Lock()
+		defer _spoolMu.Unlock()
+
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		sort.Slice(fis, func(i, j int) bool {
+			return fis[i].Name() < fis[j].Name()
+		})
+
+		for _, fi := range fis {
+			name := fi.Name()
+			if fi.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			fname := path.Join(dir, name)
+			if replayFile(fname) {
+				os.Remove(fname)
+			}
+		}
+	})
+}
+
+// Sends spooled notification once.
+// Tells if it was delivered or is broken and must be removed.
+func replayFile(fname string) bool {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return false
+	}
+	var e spoolEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		ERROR("diag", "Removing broken spool file", "file", fname, "err", err)
+		return true
+	}
+
+	switch {
+	case e.Record != nil && e.Notifier == "":
+		if !notificationsSet() {
+			return false
+		}
+		// Recent records of this run don't belong to it
+		if e.Record.Recent == nil {
+			e.Record.Recent = []*Record{}
+		}
+		notify(e.Record)
+		return true
+
+	case e.Record != nil:
+		n := findNotifier(e.Notifier)
+		if n == nil {
+			return false
+		}
+		return replayed(n.Notify(e.Record))
+
+	case e.Email != nil:
+		en := emailNotifier()
+		if en == nil || len(e.Email.To) == 0 || en.sendProc != nil {
+			return false
+		}
+		msg := &EmailMessage{
+			Sender:    en.sender,
+			Recipient: e.Email.To[0].toMap(),
+			Subject:   e.Email.Subject,
+			Text:      e.Email.Text,
+			HTML:      e.Email.Body,
+		}
+		if en.send != nil {
+			return replayed(en.send(msg))
+		}
+		email, err := newSMTPEmail(en.sender, msg, e.Email.To)
+		if err != nil {
+			return false
+		}
+		return replayed(email.Send())
+	}
+	return true
+}
+
+// Counts replay attempt, tells if it was delivered.
+func replayed(err error) bool {
+	countNotify(err)
+	return err == nil
+}
+
+func findNotifier(key string) Notifier {
+	_notifiersMu.RLock()
+	defer _notifiersMu.RUnlock()
+	for _, n := range _notifiers {
+		if notifierKey(n) == key {
+			return n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package diag
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/deze333/diag/field"
+	"github.com/deze333/diag/util"
+)
+
+//------------------------------------------------------------
+// Stack traces
+//------------------------------------------------------------
+
+// Functions of package diag itself and its util package
+const (
+	diagPkg = "github.com/deze333/diag."
+	utilPkg = "github.com/deze333/diag/util."
+)
+
+// Shorten file paths in stack traces
+var _stackTrimPaths atomic.Bool
+
+// Shortens file paths in stack traces to package path
+// and file name, ie github.com/me/app/db/query.go.
+func SetStackTrimPaths(enabled bool) {
+	_stackTrimPaths.Store(enabled)
+}
+
+// Records at this level and above get stack trace,
+// nil if none do
+var _stackLevel atomic.Pointer[Level]
+
+// Attaches stack trace to every record at level and above,
+// ie LevelError. Records that already have one are left as is.
+func SetStackLevel(level Level) {
+	_stackLevel.Store(&level)
+}
+
+// Stops attaching stack traces set by SetStackLevel.
+func ClearStackLevel() {
+	_stackLevel.Store(nil)
+}
+
+// Value of WithStack field
+type stackRequest struct{}
+
+// Set once WithStack is used, until then only levels
+// set by SetStackLevel need args scanned
+var _stackRequested atomic.Bool
+
+// Warns once about trailing "stack" argument of SOS
+var _stackMarkerOnce sync.Once
+
+// Requests stack trace to be attached to record at any level:
+//
+//	diag.ERROR("db", "query failed", "err", err, diag.WithStack())
+//
+// If arguments hold an error that carries own stack trace,
+// that one is attached instead of the logging site's.
+func WithStack() Field {
+	if !_stackRequested.Load() {
+		_stackRequested.Store(true)
+	}
+	return field.Any("stack", stackRequest{})
+}
+
+// Replaces trailing "stack" argument, that requested stack
+// trace of SOS before WithStack, with WithStack field.
+// Warns once that the marker is deprecated.
+func stackMarker(args []interface{}) []interface{} {
+	k, ok := field.Trailing(args)
+	if s, _ := k.(string); !ok || s != "stack" {
+		return args
+	}
+	n := len(args)
+	caller := externalCaller()
+	_stackMarkerOnce.Do(func() {
+		WARNING("diag", `Trailing "stack" argument of SOS is deprecated, use diag.WithStack()`, "caller", caller)
+	})
+	return append(args[:n-1:n-1], WithStack())
+}
+
+// Replaces WithStack field in args with stack trace, or appends
+// one if level always gets it. Args are copied, not modified.
+// Args are only scanned if level gets stack trace or WithStack
+// has been used.
+func attachStack(level Level, args []interface{}) []interface{} {
+	l := _stackLevel.Load()
+	always := l != nil && level >= *l
+	if !always && !_stackRequested.Load() {
+		return args
+	}
+
+	at, has := -1, false
+	for i, a := range args {
+		if f, ok := a.(field.Field); ok {
+			a = f.Any
+		}
+		switch a.(type) {
+		case stackRequest:
+			at = i
+		case util.StackTrace:
+			has = true
+		}
+	}
+
+	if at == -1 && (has || !always) {
+		return args
+	}
+
+	out := make([]interface{}, 0, len(args)+1)
+	for i, a := range args {
+		if i != at {
+			out = append(out, a)
+		}
+	}
+	if !has {
+		out = append(out, field.Any("stack", argsStack(args)))
+	}
+	return out
+}
+
+// Returns stack trace of code calling diag,
+// without diag and runtime frames.
+func callerStack() util.StackTrace {
+	st := util.Frames(1).Without(diagPkg).WithoutRuntime()
+	if _stackTrimPaths.Load() {
+		st = st.TrimPaths()
+	}
+	return st
+}
+
+// Returns origin stack of first error in args that carries one,
+// otherwise stack of code calling diag.
+func argsStack(args []interface{}) util.StackTrace {
+	for _, a := range args {
+		if f, ok := a.(field.Field); ok {
+			a = f.Any
+		}
+		err, ok := a.(error)
+		if !ok {
+			continue
+		}
+		if st := util.ErrorStack(err).WithoutRuntime(); len(st) != 0 {
+			if _stackTrimPaths.Load() {
+				st = st.TrimPaths()
+			}
+			return st
+		}
+	}
+	return callerStack()
+}
+
+// Returns file:line of the first caller outside of diag.
+func externalCaller() string {
+	st := callerStack()
+	if len(st) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", st[0].File, st[0].Line)
+}
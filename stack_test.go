@@ -0,0 +1,35 @@
+package diag
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStackMarker(t *testing.T) {
+	restore := RedirectOutput(nil)
+	defer restore()
+
+	err := errors.New("timeout")
+	for _, tc := range []struct {
+		args   []interface{}
+		marker bool
+	}{
+		{[]interface{}{"stack"}, true},
+		{[]interface{}{"host", "db1", "stack"}, true},
+		{[]interface{}{Err(err), "stack"}, true},
+		{[]interface{}{Err(err), "host", "db1", "stack"}, true},
+		{[]interface{}{"note", "stack"}, false},
+		{[]interface{}{Err(err), "note", "stack"}, false},
+		{[]interface{}{"host", "db1"}, false},
+	} {
+		got := stackMarker(tc.args)
+		f, _ := got[len(got)-1].(Field)
+		_, replaced := f.Any.(stackRequest)
+		if replaced != tc.marker {
+			t.Errorf("%v: marker replaced %v, want %v", tc.args, replaced, tc.marker)
+		}
+		if replaced && len(got) != len(tc.args) {
+			t.Errorf("%v: got %d args", tc.args, len(got))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package diag
+
+import (
+	"log"
+	"strings"
+)
+
+//------------------------------------------------------------
+// Standard log package redirection
+//------------------------------------------------------------
+
+// Redirects output of Go's standard log package into diag.
+// Every line printed via log.Print* becomes a diag record
+// of given level under given name. Standard log prefix and
+// file location, if configured by flags, are parsed out and
+// added as arguments. Timestamp is dropped as diag has its own.
+// Returns function that restores previous standard log output.
+func RedirectStdLog(level Level, name string) (restore func()) {
+	prev := log.Writer()
+	log.SetOutput(&stdLogWriter{level: level, name: name})
+	return func() {
+		log.SetOutput(prev)
+	}
+}
+
+// Receives formatted lines from standard logger.
+type stdLogWriter struct {
+	level Level
+	name  string
+}
+
+func (w *stdLogWriter) Write(p []byte) (int, error) {
+	msg, args := parseStdLog(string(p), log.Prefix(), log.Flags())
+	logAt(w.level, w.name, msg, args...)
+	return len(p), nil
+}
+
+// Splits standard log line into message and arguments
+// according to the prefix and flags the line was formatted with.
+func parseStdLog(s, prefix string, flags int) (msg string, args []interface{}) {
+	s = strings.TrimSuffix(s, "\n")
+
+	// Prefix at the beginning of line
+	if prefix != "" && flags&log.Lmsgprefix == 0 && strings.HasPrefix(s, prefix) {
+		s = s[len(prefix):]
+		args = append(args, "prefix", strings.TrimSpace(prefix))
+	}
+
+	// Date: 2009/01/23
+	if flags&log.Ldate != 0 && len(s) >= 11 && s[4] == '/' && s[7] == '/' {
+		s = s[11:]
+	}
+
+	// Time: 01:23:23 or 01:23:23.123123
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		n := 8
+		if flags&log.Lmicroseconds != 0 {
+			n += 7
+		}
+		if len(s) > n && s[2] == ':' && s[5] == ':' {
+			s = s[n+1:]
+		}
+	}
+
+	// File: /a/b/c/d.go:23 or d.go:23
+	if flags&(log.Lshortfile|log.Llongfile) != 0 {
+		if idx := strings.Index(s, ": "); idx != -1 {
+			args = append(args, "caller", s[:idx])
+			s = s[idx+2:]
+		}
+	}
+
+	// Prefix right before the message
+	if prefix != "" && flags&log.Lmsgprefix != 0 && strings.HasPrefix(s, prefix) {
+		s = s[len(prefix):]
+		args = append(args, "prefix", strings.TrimSpace(prefix))
+	}
+
+	return s, args
+}
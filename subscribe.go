@@ -0,0 +1,176 @@
+package diag
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------
+// Subscriptions
+//------------------------------------------------------------
+
+// Selects records delivered to subscriber.
+type Filter struct {
+	// Minimum level
+	Level Level
+
+	// Pattern of record name as in path.Match, ie "payments*".
+	// Empty matches all names.
+	Name string
+
+	// Records buffered for subscriber, 256 if not set
+	Size int
+
+	// What to do with a record when buffer is full:
+	// OverflowDropOldest drops oldest buffered record,
+	// any other policy drops record being logged.
+	// Subscribers never block logging.
+	Policy OverflowPolicy
+}
+
+const defaultSubscriberSize = 256
+
+type subscriber struct {
+	filter  Filter
+	c       chan Record
+	mu      sync.Mutex
+	closed  bool
+	dropped atomic.Uint64
+}
+
+var (
+	_subsMu sync.Mutex
+	_subs   atomic.Pointer[[]*subscriber]
+
+	// Count of records dropped by all subscribers
+	_subsDropped atomic.Uint64
+)
+
+// Streams records matching filter as they are logged,
+// including those below level set by SetLevel.
+// Cancel stops delivery and closes the channel.
+func Subscribe(filter Filter) (<-chan Record, func()) {
+	if filter.Size <= 0 {
+		filter.Size = defaultSubscriberSize
+	}
+	s := &subscriber{filter: filter, c: make(chan Record, filter.Size)}
+
+	_subsMu.Lock()
+	subs := append(subscribers(), s)
+	_subs.Store(&subs)
+	_subsMu.Unlock()
+	updateMinLevel()
+
+	var once sync.Once
+	return s.c, func() {
+		once.Do(func() { unsubscribe(s) })
+	}
+}
+
+// Returns number of records dropped for subscriber
+// because its channel was full.
+func SubscriberDropped(c <-chan Record) uint64 {
+	for _, s := range subscribers() {
+		if (<-chan Record)(s.c) == c {
+			return s.dropped.Load()
+		}
+	}
+	return 0
+}
+
+func unsubscribe(s *subscriber) {
+	_subsMu.Lock()
+	old := subscribers()
+	subs := make([]*subscriber, 0, len(old))
+	for _, v := range old {
+		if v != s {
+			subs = append(subs, v)
+		}
+	}
+	_subs.Store(&subs)
+	_subsMu.Unlock()
+	updateMinLevel()
+
+	s.mu.Lock()
+	s.closed = true
+	close(s.c)
+	s.mu.Unlock()
+}
+
+func subscribers() []*subscriber {
+	if p := _subs.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Returns the lowest level any subscriber takes,
+// false if there are no subscribers.
+func subscribersLevel() (Level, bool) {
+	subs := subscribers()
+	if len(subs) == 0 {
+		return 0, false
+	}
+	min := subs[0].filter.Level
+	for _, s := range subs[1:] {
+		if s.filter.Level < min {
+			min = s.filter.Level
+		}
+	}
+	return min, true
+}
+
+// Delivers copy of record to matching subscribers.
+func publish(rec *Record, args []interface{}) {
+	var c *Record
+	for _, s := range subscribers() {
+		if !s.match(rec) {
+			continue
+		}
+		if c == nil {
+			c = rec.clone(args)
+			c.Recent = nil
+		}
+		s.send(*c)
+	}
+}
+
+func (s *subscriber) match(rec *Record) bool {
+	if rec.Level < s.filter.Level {
+		return false
+	}
+	if s.filter.Name != "" {
+		if ok, _ := path.Match(s.filter.Name, rec.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *subscriber) send(rec Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.c <- rec:
+		return
+	default:
+	}
+
+	if s.filter.Policy == OverflowDropOldest {
+		select {
+		case <-s.c:
+		default:
+		}
+		select {
+		case s.c <- rec:
+		default:
+		}
+	}
+	s.dropped.Add(1)
+	_subsDropped.Add(1)
+}
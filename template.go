@@ -0,0 +1,215 @@
+package diag
+
+import (
+	"bytes"
+	"fmt"
+	htmltpl "html/template"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/deze333/diag/field"
+	"github.com/deze333/diag/util"
+)
+
+//------------------------------------------------------------
+// SOS email templates
+//------------------------------------------------------------
+
+// Data available to SOS email templates.
+type EmailData struct {
+	Prefix  string
+	Name    string
+	Title   string
+	Time    time.Time
+	Host    string
+	Process string
+	PID     int
+	Caller  string
+	Stack   string
+	Frames  util.StackTrace
+	Params  []EmailParam
+	Meta    []EmailParam
+	Recent  []*Record
+	Record  *Record
+}
+
+// Argument of SOS. Key is empty for single argument.
+type EmailParam struct {
+	Key   string
+	Value string
+}
+
+const defaultSubjectTpl = `[{{.Prefix}}] {{.Name}} : {{.Title}}`
+
+const defaultTextTpl = `{{.Name}}
+{{.Title}}
+{{range .Params}}
+{{if .Key}}* {{.Key}} = {{end}}{{.Value}}{{end}}
+{{if .Stack}}
+stack:
+{{.Stack}}
+{{end}}{{if .Recent}}
+preceding events:
+{{range .Recent}}{{.String}}
+{{end}}{{end}}
+--
+{{.Host}} / {{.Process}} [{{.PID}}]{{if .Caller}} / {{.Caller}}{{end}}
+{{.Time.Format "Mon Jan _2 15:04:05 2006"}}
+{{range .Meta}}{{.Key}} = {{.Value}}
+{{end}}`
+
+const defaultHTMLTpl = `
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+</head>
+<body>
+<div style="font-family: monospace; font-size: 13px; color: maroon;">
+{{.Name}}<br><strong>{{.Title}}</strong>
+</div>
+<hr>
+<div style="font-family: monospace; font-size: 11px;">
+{{range .Params}}{{if .Key}}<strong>{{.Key}}</strong> = {{end}}{{lines .Value}}<br>
+{{end}}
+</div>
+{{if .Frames}}<hr>
+<div style="font-family: monospace; font-size: 11px;">
+{{stack .Frames}}</div>
+{{else if .Stack}}<hr>
+<pre style="font-size: 11px;">{{.Stack}}</pre>
+{{end}}{{if .Recent}}<hr>
+<div style="font-family: monospace; font-size: 11px;"><strong>preceding events</strong></div>
+<pre style="font-size: 11px;">{{range .Recent}}{{.String}}
+{{end}}</pre>
+{{end}}<hr>
+<div style="font-family: monospace; font-size: 11px; color: gray;">
+{{.Host}} / {{.Process}} [{{.PID}}]{{if .Caller}} / {{.Caller}}{{end}}<br>
+{{.Time.Format "Mon Jan _2 15:04:05 2006"}}<br>
+{{range .Meta}}{{.Key}} = {{.Value}}<br>
+{{end}}</div>
+</body>
+</html>
+`
+
+var _emailTplFuncs = map[string]interface{}{
+	// Escapes text and changes \n to <br>
+	"lines": func(s string) htmltpl.HTML {
+		return htmltpl.HTML(strings.Replace(htmltpl.HTMLEscapeString(s), "\n", "<br>", -1))
+	},
+	// Renders stack frames, see util.StackTrace.HTML
+	"stack": func(st util.StackTrace) htmltpl.HTML {
+		return htmltpl.HTML(st.HTML())
+	},
+}
+
+var (
+	_emailTplMu   sync.RWMutex
+	_emailSubjTpl = template.Must(template.New("deze333/diag/subject").Parse(defaultSubjectTpl))
+	_emailTextTpl = template.Must(template.New("deze333/diag/text").Parse(defaultTextTpl))
+	_emailHTMLTpl = htmltpl.Must(htmltpl.New("deze333/diag/email").Funcs(_emailTplFuncs).Parse(defaultHTMLTpl))
+)
+
+// Sets templates of SOS emails. Templates receive EmailData.
+// Subject and text are text/template, HTML is html/template
+// with "lines" func that changes newlines to <br> and "stack"
+// func that renders Frames.
+// Empty template keeps the current one.
+func SetEmailTemplates(subject, text, html string) error {
+	var err error
+	subjTpl, textTpl, htmlTpl := _emailSubjTpl, _emailTextTpl, _emailHTMLTpl
+
+	if subject != "" {
+		if subjTpl, err = template.New("subject").Parse(subject); err != nil {
+			return err
+		}
+	}
+	if text != "" {
+		if textTpl, err = template.New("text").Parse(text); err != nil {
+			return err
+		}
+	}
+	if html != "" {
+		if htmlTpl, err = htmltpl.New("html").Funcs(_emailTplFuncs).Parse(html); err != nil {
+			return err
+		}
+	}
+
+	_emailTplMu.Lock()
+	defer _emailTplMu.Unlock()
+	_emailSubjTpl, _emailTextTpl, _emailHTMLTpl = subjTpl, textTpl, htmlTpl
+	return nil
+}
+
+// Collects template data of SOS record.
+// Argument with "stack" key goes to Stack, and to Frames
+// if it is util.StackTrace.
+func newEmailData(rec *Record) *EmailData {
+	host, process, pid := processInfo()
+	var prefix string
+	if en := emailNotifier(); en != nil {
+		prefix = en.subjectPrefix
+	}
+	data := &EmailData{
+		Prefix:  prefix,
+		Name:    rec.Name,
+		Title:   rec.Title,
+		Time:    rec.Time,
+		Host:    host,
+		Process: process,
+		PID:     pid,
+		Caller:  rec.Caller,
+		Recent:  rec.Recent,
+		Record:  rec,
+	}
+
+	// Host, process and pid have own fields
+	for _, f := range rec.Meta {
+		switch f.Key {
+		case "host", "process", "pid":
+			continue
+		}
+		data.Meta = append(data.Meta, EmailParam{Key: f.Key, Value: f.ValueString()})
+	}
+
+	if field.IsSingle(rec.Args) {
+		data.Params = []EmailParam{{Value: fmt.Sprint(rec.Args[0])}}
+		return data
+	}
+	for it := field.Iterate(rec.Args); it.More(); {
+		f, _ := it.Next()
+		if f.Key == "stack" && data.Stack == "" {
+			data.Stack = f.ValueString()
+			data.Frames, _ = f.Value().(util.StackTrace)
+			continue
+		}
+		data.Params = append(data.Params, EmailParam{Key: f.Key, Value: f.ValueString()})
+	}
+	return data
+}
+
+// Renders subject, text and HTML of email.
+func renderEmail(data *EmailData) (*EmailMessage, error) {
+	_emailTplMu.RLock()
+	subjTpl, textTpl, htmlTpl := _emailSubjTpl, _emailTextTpl, _emailHTMLTpl
+	_emailTplMu.RUnlock()
+
+	var subj, text, html bytes.Buffer
+	if err := subjTpl.Execute(&subj, data); err != nil {
+		return nil, err
+	}
+	if err := textTpl.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := htmlTpl.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	return &EmailMessage{
+		Subject: strings.TrimSpace(strings.Replace(subj.String(), "\n", " ", -1)),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
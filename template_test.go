@@ -0,0 +1,29 @@
+package diag
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deze333/diag/util"
+)
+
+func TestEmailStack(t *testing.T) {
+	st := util.StackTrace{{Function: "main.(*server).run", File: "main/server.go", Line: 42}}
+	rec := &Record{Level: LevelSOS, Time: time.Now(), Name: "db", Title: "lost <conn>", Args: []interface{}{"stack", st}}
+	msg, err := renderEmail(newEmailData(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<strong>main.(*server).run</strong><br>\n&nbsp;&nbsp;&nbsp;&nbsp;main/server.go:42<br>"
+	if !strings.Contains(msg.HTML, want) {
+		t.Errorf("HTML doesn't contain %q:\n%s", want, msg.HTML)
+	}
+	if !strings.Contains(msg.HTML, "lost &lt;conn&gt;") {
+		t.Errorf("HTML doesn't escape title:\n%s", msg.HTML)
+	}
+	if !strings.Contains(msg.Text, st.Text()) {
+		t.Errorf("text doesn't contain stack:\n%s", msg.Text)
+	}
+}
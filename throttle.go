@@ -0,0 +1,282 @@
+package diag
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------
+// SOS email throttling
+//------------------------------------------------------------
+
+// Interval of digest when throttling is on but digest isn't set
+const defaultDigestInterval = time.Hour
+
+// SOS events not emailed individually
+type digestItem struct {
+	name   string
+	title  string
+	count  int
+	first  time.Time
+	last   time.Time
+	params []EmailParam
+}
+
+type emailThrottle struct {
+	mu sync.Mutex
+
+	dedupe  time.Duration
+	perHour int
+	digest  time.Duration
+
+	// Last time email with name and title was sent,
+	// expired ones are pruned at most once per window
+	sent   map[string]time.Time
+	pruned time.Time
+
+	// Emails sent within current hour
+	hourStart time.Time
+	hourCount int
+
+	pending map[string]*digestItem
+	timer   *time.Timer
+}
+
+var _emailThrottle = &emailThrottle{}
+
+// Limits SOS emails. Emails with same name and title are sent
+// only once within dedupe period. No more than perHour emails
+// are sent within an hour. Zero turns respective limit off.
+// Suppressed emails are summarised in a digest email.
+func SetEmailThrottle(dedupe time.Duration, perHour int) {
+	t := _emailThrottle
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dedupe = dedupe
+	t.perHour = perHour
+}
+
+// Batches SOS emails into a digest sent every interval.
+// The first email with given name and title is still sent
+// immediately, repeated ones within interval go to digest.
+// Zero interval turns digest mode off.
+func SetEmailDigest(interval time.Duration) {
+	t := _emailThrottle
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.digest = interval
+}
+
+// Tells if email must be sent now.
+// Otherwise email is added to digest.
+func (t *emailThrottle) admit(name, title string, args []interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dedupe <= 0 && t.perHour <= 0 && t.digest <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	key := name + "\x00" + title
+
+	// Repeated email
+	window := t.window()
+	if last, ok := t.sent[key]; ok && window > 0 && now.Sub(last) < window {
+		t.postpone(key, name, title, args, now)
+		return false
+	}
+
+	// Hourly cap
+	if now.Sub(t.hourStart) >= time.Hour {
+		t.hourStart = now
+		t.hourCount = 0
+	}
+	if t.perHour > 0 && t.hourCount >= t.perHour {
+		t.postpone(key, name, title, args, now)
+		return false
+	}
+
+	t.hourCount++
+	if window <= 0 {
+		return true
+	}
+	if t.sent == nil {
+		t.sent = map[string]time.Time{}
+	}
+	if now.Sub(t.pruned) >= window {
+		t.prune(now)
+	}
+	t.sent[key] = now
+	return true
+}
+
+// Period within which repeated email is not sent
+func (t *emailThrottle) window() time.Duration {
+	if t.dedupe > 0 {
+		return t.dedupe
+	}
+	return t.digest
+}
+
+// Forgets emails sent before current window.
+func (t *emailThrottle) prune(now time.Time) {
+	window := t.window()
+	for key, last := range t.sent {
+		if window <= 0 || now.Sub(last) >= window {
+			delete(t.sent, key)
+		}
+	}
+	t.pruned = now
+}
+
+// Adds email to digest and schedules digest send.
+func (t *emailThrottle) postpone(key, name, title string, args []interface{}, now time.Time) {
+	if t.pending == nil {
+		t.pending = map[string]*digestItem{}
+	}
+
+	item := t.pending[key]
+	if item == nil {
+		item = &digestItem{name: name, title: title, first: now}
+		t.pending[key] = item
+	}
+	item.count++
+	item.last = now
+	item.params = newEmailData(&Record{Args: args}).Params
+
+	if t.timer == nil {
+		interval := t.digest
+		if interval <= 0 {
+			interval = defaultDigestInterval
+		}
+		t.timer = time.AfterFunc(interval, t.flush)
+	}
+}
+
+// Sends digest of postponed emails.
+func (t *emailThrottle) flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	t.prune(time.Now())
+	t.mu.Unlock()
+
+	if len(pending) == 0 || emailNotifier() == nil {
+		return
+	}
+	sendDigest(pending)
+}
+
+// Sends digest of postponed SOS events to their recipients.
+// Events routed to the same recipients share one email.
+func sendDigest(pending map[string]*digestItem) {
+	items := make([]*digestItem, 0, len(pending))
+	for _, item := range pending {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].first.Before(items[j].first)
+	})
+
+	var keys []string
+	groups := map[string][]*digestItem{}
+	recipients := map[string][]Recipient{}
+	for _, item := range items {
+		rcpts := recipientsFor(item.name)
+		key := fmt.Sprint(rcpts)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			recipients[key] = rcpts
+		}
+		groups[key] = append(groups[key], item)
+	}
+
+	for _, key := range keys {
+		sendDigestEmail(groups[key], recipients[key])
+	}
+}
+
+// Sends one email summarising postponed SOS events.
+func sendDigestEmail(items []*digestItem, recipients []Recipient) {
+	total := 0
+	for _, item := range items {
+		total += item.count
+	}
+
+	title := fmt.Sprintf("SOS digest: %s events suppressed", formatCount(total))
+	data := newEmailData(&Record{Level: LevelSOS, Time: time.Now(), Name: "diag", Title: title})
+	for _, item := range items {
+		data.Params = append(data.Params,
+			EmailParam{Value: item.name + " : " + item.title},
+			EmailParam{Key: "count", Value: formatCount(item.count)},
+			EmailParam{Key: "first", Value: item.first.Format(time.ANSIC)},
+			EmailParam{Key: "last", Value: item.last.Format(time.ANSIC)})
+		data.Params = append(data.Params, item.params...)
+		data.Params = append(data.Params, EmailParam{})
+	}
+
+	msg, err := renderEmail(data)
+	if err != nil {
+		ERROR("diag", "Error generating SOS digest email via template. Email send aborted.", "err", err)
+		return
+	}
+	sendEmail(msg, recipients)
+}
+
+// Sends digest of postponed emails right away.
+func flushEmailDigest() {
+	_emailThrottle.flush()
+}
+
+// Clears history of sent emails, pending digest and sampling
+// counts, keeping settings. Returned func discards state built
+// since and restores previous one. Meant for tests, see diagtest.
+func ResetThrottling() (restore func()) {
+	restoreEmail := _emailThrottle.reset()
+	restoreSampler := func() {}
+	if s := _sampler.Load(); s != nil {
+		restoreSampler = s.reset()
+	}
+	return func() {
+		restoreSampler()
+		restoreEmail()
+	}
+}
+
+func (t *emailThrottle) reset() (restore func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sent, hourStart, hourCount, pending := t.sent, t.hourStart, t.hourCount, t.pending
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.sent, t.hourStart, t.hourCount, t.pending = nil, time.Time{}, 0, nil
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.timer != nil {
+			t.timer.Stop()
+			t.timer = nil
+		}
+		t.sent, t.hourStart, t.hourCount, t.pending = sent, hourStart, hourCount, pending
+
+		// Digest is rescheduled with full interval
+		if len(pending) != 0 {
+			interval := t.digest
+			if interval <= 0 {
+				interval = defaultDigestInterval
+			}
+			t.timer = time.AfterFunc(interval, t.flush)
+		}
+	}
+}
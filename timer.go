@@ -0,0 +1,86 @@
+package diag
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//------------------------------------------------------------
+// Timed operations
+//------------------------------------------------------------
+
+// Default duration over which timed operations log WARNING
+var _timerThreshold atomic.Int64
+
+// Sets duration over which timed operations are logged
+// as WARNING instead of DEBUG. Zero never escalates.
+func SetTimerThreshold(d time.Duration) {
+	_timerThreshold.Store(int64(d))
+}
+
+// Operation started by Timer.
+type Timing struct {
+	name      string
+	title     string
+	args      []interface{}
+	start     time.Time
+	threshold time.Duration
+}
+
+// Starts timing an operation. Stop logs it with elapsed time:
+//
+//	defer diag.Timer("db", "query", "table", "users").Stop()
+func Timer(name, title string, v ...interface{}) *Timing {
+	return &Timing{
+		name:      name,
+		title:     title,
+		args:      v,
+		start:     time.Now(),
+		threshold: time.Duration(_timerThreshold.Load()),
+	}
+}
+
+// Sets duration over which this operation is logged as WARNING.
+func (t *Timing) WarnAfter(d time.Duration) *Timing {
+	t.threshold = d
+	return t
+}
+
+// Logs operation with arguments given to Timer, then v,
+// then elapsed time as "took". Returns elapsed time.
+func (t *Timing) Stop(v ...interface{}) time.Duration {
+	took := time.Since(t.start)
+	slow := t.threshold > 0 && took >= t.threshold
+
+	level := LevelDebug
+	if slow {
+		level = LevelWarning
+	}
+	if !Enabled(level) {
+		return took
+	}
+
+	args := make([]interface{}, 0, len(t.args)+len(v)+2)
+	args = append(args, t.args...)
+	args = append(args, v...)
+	args = append(args, Dur("took", roundDuration(took)))
+	if slow {
+		args = append(args, Dur("threshold", t.threshold))
+		WARNING(t.name, t.title, args...)
+	} else {
+		DEBUG(t.name, t.title, args...)
+	}
+	return took
+}
+
+// Rounds duration to three decimals of its unit,
+// ie 1.234s, 56.789ms.
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d
+}
@@ -24,39 +24,13 @@ func GetFuncInfo(obj interface{}) []string {
 	}
 }
 
-// Returns full stack trace as string.
+// Returns stack trace of current goroutine as text,
+// starting with StackFull itself.
 func StackFull() string {
-	return stack(0)
+	return Frames(0).Text()
 }
 
-// Returns stack trace as string, skipping few first lines.
+// Returns stack trace as text, starting with the caller.
 func Stack() string {
-	return stack(5)
-}
-
-// Stack implementation.
-func stack(skip int) string {
-	buf := make([]byte, 1024)
-	size := 0
-	for {
-		size = runtime.Stack(buf, false)
-		if size < len(buf) {
-			break
-		}
-		buf = make([]byte, len(buf)*2)
-	}
-
-	// Skip first 5 newlines
-	var count = 0
-	var idx = 0
-	for idx < size {
-		if count == skip {
-			break
-		}
-		if buf[idx] == '\n' {
-			count++
-		}
-		idx++
-	}
-	return string(buf[idx:size])
+	return Frames(1).Text()
 }
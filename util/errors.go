@@ -0,0 +1,81 @@
+package util
+
+import (
+	"reflect"
+)
+
+//------------------------------------------------------------
+// Error chains
+//------------------------------------------------------------
+
+// Returns errors wrapped by err: one for errors made
+// with fmt.Errorf("%w"), several for errors.Join.
+func ErrorCauses(err error) []error {
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		return e.Unwrap()
+	case interface{ Unwrap() error }:
+		if cause := e.Unwrap(); cause != nil {
+			return []error{cause}
+		}
+	}
+	return nil
+}
+
+// Returns stack trace carried by err or errors it wraps.
+// Of several, the innermost one is returned as it is
+// closest to the origin of error. Recognised are methods:
+//
+//	StackTrace() util.StackTrace
+//	StackTrace() []uintptr, or slice of uintptr-based frames
+//	Callers() []uintptr
+func ErrorStack(err error) StackTrace {
+	var st StackTrace
+	walkErrors(err, 0, func(e error) {
+		if s := ownStack(e); len(s) != 0 {
+			st = s
+		}
+	})
+	return st
+}
+
+// Calls fn for err and errors it wraps, outermost first.
+func walkErrors(err error, depth int, fn func(error)) {
+	if err == nil || depth > maxErrorDepth {
+		return
+	}
+	fn(err)
+	for _, cause := range ErrorCauses(err) {
+		walkErrors(cause, depth+1, fn)
+	}
+}
+
+// Limits walking of deep or cyclic chains
+const maxErrorDepth = 32
+
+// Stack trace of err itself, not of errors it wraps.
+func ownStack(err error) StackTrace {
+	switch e := err.(type) {
+	case interface{ StackTrace() StackTrace }:
+		return e.StackTrace()
+	case interface{ Callers() []uintptr }:
+		return FramesOf(e.Callers())
+	}
+
+	// StackTrace() returning slice of program counters,
+	// ie github.com/pkg/errors.StackTrace
+	m := reflect.ValueOf(err).MethodByName("StackTrace")
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return nil
+	}
+	t := m.Type().Out(0)
+	if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uintptr {
+		return nil
+	}
+	v := m.Call(nil)[0]
+	pcs := make([]uintptr, v.Len())
+	for i := range pcs {
+		pcs[i] = uintptr(v.Index(i).Uint())
+	}
+	return FramesOf(pcs)
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+)
+
+//------------------------------------------------------------
+// Formatting utils
+//------------------------------------------------------------
+
+// Appends value formatted as with %v to b.
+// Common types are formatted without allocations.
+func AppendValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(b, v...)
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(b, v, 10)
+	case int32:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uint:
+		return strconv.AppendUint(b, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(b, v, 10)
+	case uint32:
+		return strconv.AppendUint(b, uint64(v), 10)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case nil:
+		return append(b, "<nil>"...)
+	}
+	return fmt.Append(b, v)
+}
+
+// Tells if value is an empty string.
+func IsEmpty(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && s == ""
+}
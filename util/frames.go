@@ -0,0 +1,143 @@
+package util
+
+import (
+	"bytes"
+	"html"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------
+// Structured stack traces
+//------------------------------------------------------------
+
+// Single stack frame.
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// Stack frames, innermost first.
+type StackTrace []Frame
+
+// Returns stack trace of current goroutine.
+// Skip 0 starts with the function calling Frames.
+func Frames(skip int) StackTrace {
+	pcs := make([]uintptr, 64)
+	var n int
+	for {
+		n = runtime.Callers(skip+2, pcs)
+		if n < len(pcs) {
+			break
+		}
+		pcs = make([]uintptr, len(pcs)*2)
+	}
+	return FramesOf(pcs[:n])
+}
+
+// Returns stack trace of given program counters,
+// ie those kept by an error value.
+func FramesOf(pcs []uintptr) StackTrace {
+	st := make(StackTrace, 0, len(pcs))
+	if len(pcs) == 0 {
+		return st
+	}
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		st = append(st, Frame{Function: f.Function, File: f.File, Line: f.Line})
+		if !more {
+			break
+		}
+	}
+	return st
+}
+
+// Returns frames except those of runtime package.
+func (st StackTrace) WithoutRuntime() StackTrace {
+	return st.Without("runtime.")
+}
+
+// Returns frames except those whose function starts with
+// any of the prefixes, ie "github.com/deze333/diag.".
+func (st StackTrace) Without(prefixes ...string) StackTrace {
+	out := make(StackTrace, 0, len(st))
+	for _, f := range st {
+		skip := false
+		for _, p := range prefixes {
+			if strings.HasPrefix(f.Function, p) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// Returns frames with file paths shortened to package path
+// and file name, ie net/http/server.go. That removes GOROOT,
+// GOPATH, module cache and checkout directory.
+func (st StackTrace) TrimPaths() StackTrace {
+	out := make(StackTrace, len(st))
+	for i, f := range st {
+		if pkg := funcPackage(f.Function); pkg != "" {
+			f.File = pkg + "/" + filepath.Base(f.File)
+		}
+		out[i] = f
+	}
+	return out
+}
+
+// Renders frames like runtime.Stack does:
+//
+//	main.main()
+//		/path/main.go:12
+func (st StackTrace) Text() string {
+	var b bytes.Buffer
+	for _, f := range st {
+		b.WriteString(f.Function)
+		b.WriteString("()\n\t")
+		b.WriteString(f.File)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(f.Line))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Renders frames as escaped HTML, frame per line.
+func (st StackTrace) HTML() string {
+	var b bytes.Buffer
+	for _, f := range st {
+		b.WriteString("<strong>")
+		b.WriteString(html.EscapeString(f.Function))
+		b.WriteString("</strong><br>\n&nbsp;&nbsp;&nbsp;&nbsp;")
+		b.WriteString(html.EscapeString(f.File))
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(f.Line))
+		b.WriteString("<br>\n")
+	}
+	return b.String()
+}
+
+// Same as Text, so stack traces print as text.
+func (st StackTrace) String() string {
+	return st.Text()
+}
+
+// Package path of function name:
+// net/http.(*conn).serve is in net/http.
+func funcPackage(fn string) string {
+	slash := strings.LastIndex(fn, "/")
+	dot := strings.Index(fn[slash+1:], ".")
+	if dot == -1 {
+		return ""
+	}
+	return fn[:slash+1+dot]
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------
+// Goroutine dumps
+//------------------------------------------------------------
+
+// Goroutines sharing same state and stack.
+type GoroutineGroup struct {
+	Count     int        `json:"count"`
+	State     string     `json:"state"`
+	Stack     StackTrace `json:"frames"`
+	CreatedBy *Frame     `json:"created_by,omitempty"`
+}
+
+// Header of group, as in pprof goroutine debug=1 view:
+// 3 @ [chan receive].
+func (g GoroutineGroup) Header() string {
+	return strconv.Itoa(g.Count) + " @ [" + g.State + "]"
+}
+
+// Renders stack of group and the function that
+// created its goroutines.
+func (g GoroutineGroup) String() string {
+	var b bytes.Buffer
+	b.WriteString(g.Stack.Text())
+	if g.CreatedBy != nil {
+		b.WriteString("created by ")
+		b.WriteString(StackTrace{*g.CreatedBy}.Text())
+	}
+	return b.String()
+}
+
+// Goroutine groups of a dump. Marshals to JSON array.
+type GoroutineGroups []GoroutineGroup
+
+// Renders groups with headers:
+//
+//	3 @ [chan receive]
+//	main.worker()
+//		/path/main.go:12
+func (gs GoroutineGroups) String() string {
+	var b bytes.Buffer
+	for i, g := range gs {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(g.Header())
+		b.WriteString("\n")
+		b.WriteString(g.String())
+	}
+	return b.String()
+}
+
+// Returns stacks of all goroutines grouped by state and stack,
+// largest groups first. Total is number of goroutines.
+func Goroutines() (groups GoroutineGroups, total int) {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	return ParseGoroutines(string(buf))
+}
+
+// Parses output of runtime.Stack for all goroutines
+// and groups goroutines with identical stacks.
+// Arguments, offsets and wait durations are ignored.
+func ParseGoroutines(dump string) (groups GoroutineGroups, total int) {
+	index := map[string]int{}
+	for _, block := range strings.Split(dump, "\n\n") {
+		g, ok := parseGoroutine(block)
+		if !ok {
+			continue
+		}
+		total++
+
+		key := g.State + "\n" + g.String()
+		if i, ok := index[key]; ok {
+			groups[i].Count++
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, g)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Count > groups[j].Count
+	})
+	return groups, total
+}
+
+// Parses single goroutine:
+//
+//	goroutine 7 [chan receive, 2 minutes]:
+//	main.worker(0xc000012345)
+//		/path/main.go:12 +0x1d
+//	created by main.main in goroutine 1
+//		/path/main.go:30 +0x5a
+func parseGoroutine(block string) (g GoroutineGroup, ok bool) {
+	lines := strings.Split(strings.TrimSpace(block), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "goroutine ") {
+		return g, false
+	}
+
+	// State without wait duration and thread lock
+	header := lines[0]
+	start, end := strings.Index(header, "["), strings.LastIndex(header, "]")
+	if start == -1 || end < start {
+		return g, false
+	}
+	g.State = header[start+1 : end]
+	if i := strings.Index(g.State, ","); i != -1 {
+		g.State = g.State[:i]
+	}
+	g.Count = 1
+
+	for i := 1; i < len(lines); i++ {
+		fn := lines[i]
+		if strings.HasPrefix(fn, "...") {
+			continue
+		}
+		f := Frame{Function: fn}
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\t") {
+			f.File, f.Line = parseFileLine(lines[i+1])
+			i++
+		}
+
+		if strings.HasPrefix(fn, "created by ") {
+			fn = strings.TrimPrefix(fn, "created by ")
+			if j := strings.Index(fn, " in goroutine "); j != -1 {
+				fn = fn[:j]
+			}
+			f.Function = fn
+			g.CreatedBy = &f
+			continue
+		}
+
+		// Drop arguments: main.(*T).run(0xc0000, ...)
+		if strings.HasSuffix(fn, ")") {
+			if j := strings.LastIndex(fn, "("); j > 0 {
+				f.Function = fn[:j]
+			}
+		}
+		g.Stack = append(g.Stack, f)
+	}
+	return g, true
+}
+
+// Parses "\t/path/main.go:12 +0x1d".
+func parseFileLine(s string) (file string, line int) {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, " +0x"); i != -1 {
+		s = s[:i]
+	}
+	i := strings.LastIndex(s, ":")
+	if i == -1 {
+		return s, 0
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return s, 0
+	}
+	return s[:i], line
+}
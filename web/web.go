@@ -0,0 +1,317 @@
+// Web log viewer serves recent records and log files over HTTP
+package web
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deze333/diag"
+)
+
+//------------------------------------------------------------
+// Log viewer
+//------------------------------------------------------------
+
+// Serves log viewer, mounted on admin mux with its own prefix:
+//
+//	mux.Handle("/admin/logs/", http.StripPrefix("/admin/logs", web.New(dir)))
+//
+// Routes are:
+//
+//	/              page with recent records, live tail and files
+//	/records       recent records as JSON array
+//	/tail          new records as Server-Sent Events
+//	/files/{path}  download of log file
+//
+// Records are filtered by query parameters level (minimum),
+// name (pattern as in path.Match) and q (text search).
+// Recent records are those kept by diag.SetRecent.
+type Handler struct {
+	dir string
+}
+
+// Log file directories served, relative to log directory
+var fileDirs = []string{"plain", "html", "crash"}
+
+// Returns viewer of recent records and files of
+// log directory given to diag.Start.
+func New(dir string) *Handler {
+	return &Handler{dir: dir}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case p == "":
+		h.serveIndex(w, r)
+	case p == "records":
+		h.serveRecords(w, r)
+	case p == "tail":
+		h.serveTail(w, r)
+	case strings.HasPrefix(p, "files/"):
+		h.serveFile(w, r, strings.TrimPrefix(p, "files/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//------------------------------------------------------------
+// Records
+//------------------------------------------------------------
+
+// Record filter from query parameters.
+type filter struct {
+	level diag.Level
+	name  string
+	text  string
+}
+
+func parseFilter(r *http.Request) (f filter, err error) {
+	q := r.URL.Query()
+	if s := q.Get("level"); s != "" {
+		if f.level, err = diag.ParseLevel(s); err != nil {
+			return f, err
+		}
+	}
+	f.name = q.Get("name")
+	if _, err = path.Match(f.name, ""); err != nil {
+		return f, err
+	}
+	f.text = strings.ToLower(q.Get("q"))
+	return f, nil
+}
+
+func (f filter) match(rec *diag.Record) bool {
+	if rec.Level < f.level {
+		return false
+	}
+	if f.name != "" {
+		if ok, _ := path.Match(f.name, rec.Name); !ok {
+			return false
+		}
+	}
+	if f.text != "" && !strings.Contains(strings.ToLower(rec.String()), f.text) {
+		return false
+	}
+	return true
+}
+
+// Returns recent records that pass filter.
+func (f filter) recent() []*diag.Record {
+	var recs []*diag.Record
+	for _, rec := range diag.Recent() {
+		if f.match(rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func (h *Handler) serveRecords(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs := f.recent()
+	if recs == nil {
+		recs = []*diag.Record{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
+
+// Streams records as they are logged.
+func (h *Handler) serveTail(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	recs, cancel := diag.Subscribe(diag.Filter{Level: f.level, Name: f.name})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rec := <-recs:
+			if !f.match(&rec) {
+				continue
+			}
+			data, err := json.Marshal(&rec)
+			if err != nil {
+				continue
+			}
+			w.Write([]byte("data: "))
+			w.Write(data)
+			w.Write([]byte("\n\n"))
+			flusher.Flush()
+		}
+	}
+}
+
+//------------------------------------------------------------
+// Files
+//------------------------------------------------------------
+
+// Log file available for download.
+type file struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Returns log files, newest first.
+func (h *Handler) files() []file {
+	var files []file
+	for _, d := range fileDirs {
+		fis, err := ioutil.ReadDir(filepath.Join(h.dir, d))
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() {
+				files = append(files, file{Path: d + "/" + fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+	return files
+}
+
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	name = path.Clean("/" + name)[1:]
+	dir, base := path.Split(name)
+	if !isFileDir(strings.TrimSuffix(dir, "/")) || base == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(h.dir, filepath.FromSlash(name)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(base, `"`, "")+`"`)
+	http.ServeContent(w, r, base, fi.ModTime(), f)
+}
+
+func isFileDir(dir string) bool {
+	for _, d := range fileDirs {
+		if dir == d {
+			return true
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------
+// Page
+//------------------------------------------------------------
+
+func (h *Handler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	data := map[string]interface{}{
+		"Levels":  []string{"DEBUG", "NOTE", "WARNING", "ERROR", "SOS"},
+		"Level":   f.level.String(),
+		"Name":    q.Get("name"),
+		"Text":    q.Get("q"),
+		"Query":   r.URL.RawQuery,
+		"Records": f.recent(),
+		"Files":   h.files(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := _pageTpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var _pageTpl = template.Must(template.New("page").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("Jan _2 15:04:05.000") },
+	"size": func(n int64) string { return strconv.FormatInt((n+1023)/1024, 10) + " KB" },
+}).Parse(pageTpl))
+
+const pageTpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Log</title>
+<style>
+body { font-family: monospace; font-size: 13px; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 2px 6px; vertical-align: top; border-bottom: 1px solid #eee; white-space: pre-wrap; }
+.DEBUG { color: #777; } .WARNING { background: #fff6d5; } .ERROR, .SOS { background: #fde0e0; }
+</style>
+</head>
+<body>
+<form method="get">
+level <select name="level">{{range .Levels}}<option{{if eq . $.Level}} selected{{end}}>{{.}}</option>{{end}}</select>
+name <input name="name" value="{{.Name}}" placeholder="payments*">
+text <input name="q" value="{{.Text}}">
+<button>Filter</button>
+<label><input type="checkbox" id="live"> live</label>
+</form>
+<table id="records">
+{{range .Records}}<tr class="{{.Level}}"><td>{{time .Time}}</td><td>{{.Level}}</td><td>{{.Name}}</td><td>{{.String}}</td></tr>
+{{end}}</table>
+<h3>Files</h3>
+<table>
+{{range .Files}}<tr><td><a href="files/{{.Path}}">{{.Path}}</a></td><td>{{size .Size}}</td><td>{{time .ModTime}}</td></tr>
+{{end}}</table>
+<script>
+var source;
+document.getElementById("live").onchange = function() {
+	if (source) { source.close(); source = null; }
+	if (!this.checked) { return; }
+	source = new EventSource("tail?{{.Query}}");
+	source.onmessage = function(e) {
+		var r = JSON.parse(e.data), tr = document.createElement("tr");
+		tr.className = r.level;
+		[r.time, r.level, r.name || "", r.title + (r.fields ? " " + JSON.stringify(r.fields) : r.arg !== undefined ? " " + JSON.stringify(r.arg) : "")].forEach(function(v) {
+			var td = document.createElement("td");
+			td.textContent = v;
+			tr.appendChild(td);
+		});
+		document.getElementById("records").appendChild(tr);
+	};
+};
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deze333/diag"
+)
+
+// Serves viewer of log directory with plain/app.log and
+// spool/secret.json, mounted under /logs as in production.
+func newServer(t *testing.T) *httptest.Server {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"plain/app.log":     "plain log",
+		"spool/secret.json": "spooled",
+	} {
+		fname := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(data), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restore := diag.RedirectOutput(io.Discard)
+	t.Cleanup(restore)
+
+	mux := http.NewServeMux()
+	mux.Handle("/logs/", http.StripPrefix("/logs", New(dir)))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestRecords(t *testing.T) {
+	srv := newServer(t)
+	diag.SetRecent(100, diag.LevelDebug)
+	defer diag.SetRecent(0, diag.LevelDebug)
+	diag.DEBUG("db", "query", "rows", 1)
+	diag.ERROR("payments", "charge failed", "id", 42)
+
+	code, body := get(t, srv.URL+"/logs/records?level=WARNING&name=pay*")
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	var recs []struct {
+		Level string `json:"level"`
+		Name  string `json:"name"`
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal([]byte(body), &recs); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if len(recs) != 1 || recs[0].Name != "payments" || recs[0].Title != "charge failed" {
+		t.Errorf("got %+v", recs)
+	}
+
+	if code, _ := get(t, srv.URL+"/logs/records?level=LOUD"); code != http.StatusBadRequest {
+		t.Errorf("bad level status %d", code)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	srv := newServer(t)
+
+	resp, err := http.Get(srv.URL + "/logs/files/plain/app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "plain log" {
+		t.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, `filename="app.log"`) {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+
+	for _, p := range []string{
+		"files/spool/secret.json",
+		"files/plain/../spool/secret.json",
+		"files/plain/%2e%2e/spool/secret.json",
+		"files/../../etc/passwd",
+		"files/plain/",
+		"files/plain/missing.log",
+	} {
+		if code, body := get(t, srv.URL+"/logs/"+p); code != http.StatusNotFound {
+			t.Errorf("%s: status %d: %s", p, code, body)
+		}
+	}
+}
+
+func TestTail(t *testing.T) {
+	srv := newServer(t)
+
+	resp, err := http.Get(srv.URL + "/logs/tail?name=db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+
+	// Headers are flushed after subscribing, so records
+	// logged from now on are delivered
+	diag.WARNING("cache", "skipped")
+	diag.WARNING("db", "slow query", "ms", 900)
+
+	events := make(chan string, 1)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			if strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimPrefix(strings.TrimSpace(line), "data: ")
+			}
+		}
+	}()
+
+	select {
+	case data, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		var rec struct {
+			Name  string `json:"name"`
+			Title string `json:"title"`
+		}
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			t.Fatalf("%v: %s", err, data)
+		}
+		if rec.Name != "db" || rec.Title != "slow query" {
+			t.Errorf("got %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record delivered")
+	}
+}
@@ -0,0 +1,207 @@
+package diag
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/deze333/diag/field"
+)
+
+//------------------------------------------------------------
+// Webhook notifiers
+//------------------------------------------------------------
+
+const webhookTimeout = 10 * time.Second
+
+// Posts SOS record as JSON object to URL.
+// Name identifies notifier in spool and logs instead
+// of URL, that often holds a secret token.
+type WebhookNotifier struct {
+	URL    string
+	Name   string
+	Header http.Header
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url}
+}
+
+// Identifies notifier in spool and logs
+func (n *WebhookNotifier) String() string {
+	return "webhook " + webhookID(n.Name, n.URL)
+}
+
+func (n *WebhookNotifier) Notify(rec *Record) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.Client, n.URL, n.Header, body)
+}
+
+// Posts SOS record to Slack or Mattermost incoming webhook.
+// Channel, Username and IconEmoji override webhook defaults
+// when set. Prefix is prepended to message, ie app name.
+// Name identifies notifier as in WebhookNotifier.
+type SlackNotifier struct {
+	URL       string
+	Name      string
+	Channel   string
+	Username  string
+	IconEmoji string
+	Prefix    string
+	Client    *http.Client
+}
+
+func NewSlackNotifier(url, prefix string) *SlackNotifier {
+	return &SlackNotifier{URL: url, Prefix: prefix}
+}
+
+// Identifies notifier in spool and logs
+func (n *SlackNotifier) String() string {
+	return "slack " + webhookID(n.Name, n.URL)
+}
+
+func (n *SlackNotifier) Notify(rec *Record) error {
+	msg := struct {
+		Text      string `json:"text"`
+		Channel   string `json:"channel,omitempty"`
+		Username  string `json:"username,omitempty"`
+		IconEmoji string `json:"icon_emoji,omitempty"`
+	}{
+		Text:      slackText(n.Prefix, rec),
+		Channel:   n.Channel,
+		Username:  n.Username,
+		IconEmoji: n.IconEmoji,
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.Client, n.URL, nil, body)
+}
+
+// Message text with arguments in code block:
+//
+//	*[prefix] name : title*
+//	_host = vm, pid = 42_
+//	```
+//	k = v
+//	```
+func slackText(prefix string, rec *Record) string {
+	var b strings.Builder
+	b.WriteString("*")
+	if prefix != "" {
+		b.WriteString("[" + prefix + "] ")
+	}
+	b.WriteString(slackEscape(rec.Name + " : " + rec.Title))
+	b.WriteString("*")
+
+	// Metadata in one line
+	if len(rec.Meta) != 0 {
+		b.WriteString("\n_")
+		for i, f := range rec.Meta {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(slackEscape(f.Key + " = " + f.ValueString()))
+		}
+		b.WriteString("_")
+	}
+
+	if len(rec.Args) == 0 {
+		return b.String()
+	}
+	b.WriteString("\n```\n")
+	if field.IsSingle(rec.Args) {
+		b.WriteString(slackEscape(fmt.Sprint(rec.Args[0])) + "\n")
+	} else {
+		for it := field.Iterate(rec.Args); it.More(); {
+			f, _ := it.Next()
+			if f.IsSeparator() {
+				continue
+			}
+			b.WriteString(slackEscape(f.Key+" = "+f.ValueString()) + "\n")
+		}
+	}
+	b.WriteString("```")
+	return b.String()
+}
+
+// Escapes control characters of Slack message format.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// Returns name if set, otherwise URL without path and query,
+// which carry webhook token, and hash to tell URLs apart:
+//
+//	https://hooks.slack.com/... #1a2b3c4d
+func webhookID(name, rawURL string) string {
+	if name != "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return redactURL(rawURL) + " #" + hex.EncodeToString(sum[:4])
+}
+
+// Returns scheme and host of URL only.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "..."
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
+
+// Posts JSON body to URL, non 2xx status is an error.
+// Errors show URL redacted.
+func postJSON(client *http.Client, rawURL string, header http.Header, body []byte) error {
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return redactError(err)
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("diag: webhook %s returned %s: %s", redactURL(rawURL), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Removes URL path and query from error of HTTP client.
+func redactError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = redactURL(ue.URL)
+	}
+	return err
+}
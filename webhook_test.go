@@ -0,0 +1,137 @@
+package diag
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Webhook endpoint that records requests and fails
+// the first failures of them with 500.
+type hookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	types    []string
+	bodies   [][]byte
+}
+
+func newHookServer(t *testing.T, failures int) *hookServer {
+	s := &hookServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.types = append(s.types, r.Header.Get("Content-Type"))
+		s.bodies = append(s.bodies, body)
+		if len(s.bodies) <= s.failures {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *hookServer) requests() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies
+}
+
+// Sends SOS through notifier and waits until it is delivered.
+func notifyVia(t *testing.T, n Notifier, v ...interface{}) {
+	restore := RedirectOutput(io.Discard)
+	defer restore()
+	SetNotifyRetry(3, time.Millisecond)
+	defer SetNotifyRetry(3, time.Second)
+	AddNotifier(n)
+	defer RemoveNotifier(n)
+
+	SOS("db", "connection <lost>", v...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitNotifications(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	s := newHookServer(t, 0)
+	n := NewWebhookNotifier(s.URL + "/hook")
+	n.Header = http.Header{"X-Token": {"secret"}}
+	notifyVia(t, n, "host", "db1", "attempt", 2)
+
+	reqs := s.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	if s.types[0] != "application/json" {
+		t.Errorf("content type %q", s.types[0])
+	}
+
+	var got struct {
+		Level  string                 `json:"level"`
+		Name   string                 `json:"name"`
+		Title  string                 `json:"title"`
+		Fields map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal(reqs[0], &got); err != nil {
+		t.Fatalf("%v: %s", err, reqs[0])
+	}
+	if got.Level != "SOS" || got.Name != "db" || got.Title != "connection <lost>" {
+		t.Errorf("got %+v", got)
+	}
+	if got.Fields["host"] != "db1" || got.Fields["attempt"] != 2.0 {
+		t.Errorf("fields %v", got.Fields)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	s := newHookServer(t, 0)
+	n := NewSlackNotifier(s.URL+"/services/T0/B0/token", "app")
+	n.Channel = "#ops"
+	notifyVia(t, n, "host", "db1")
+
+	reqs := s.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	var got map[string]string
+	if err := json.Unmarshal(reqs[0], &got); err != nil {
+		t.Fatalf("%v: %s", err, reqs[0])
+	}
+	if got["channel"] != "#ops" {
+		t.Errorf("channel %q", got["channel"])
+	}
+	for _, want := range []string{"*[app] db : connection &lt;lost&gt;*", "```\nhost = db1\n```"} {
+		if !strings.Contains(got["text"], want) {
+			t.Errorf("text %q doesn't contain %q", got["text"], want)
+		}
+	}
+	if strings.Contains(n.String(), "token") {
+		t.Errorf("String shows URL token: %s", n.String())
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s := newHookServer(t, 2)
+	notifyVia(t, NewWebhookNotifier(s.URL))
+
+	reqs := s.requests()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(reqs))
+	}
+	for i, body := range reqs[1:] {
+		if string(body) != string(reqs[0]) {
+			t.Errorf("retry %d body differs: %s", i+1, body)
+		}
+	}
+}
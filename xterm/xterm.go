@@ -2,9 +2,10 @@
 package xterm
 
 import (
-	"fmt"
-	"strings"
 	"time"
+
+	"github.com/deze333/diag/field"
+	"github.com/deze333/diag/util"
 )
 
 const (
@@ -37,115 +38,122 @@ const (
 
 // DEBUG output
 func DEBUG(time time.Time, name, title string, args ...interface{}) string {
-	out := []string{}
-	out = append(out, fmt.Sprintf("\n%s%s\n%s%s%s", CYAN, name, YELLOW, title, CLEAR))
-
-	if len(args) == 1 {
-		out = append(out, fmt.Sprintf(" %s%v%s", WHITE, args[0], CLEAR))
-	} else {
-		for i := 0; i+1 < len(args); i += 2 {
-			k := args[i]
-			v := args[i+1]
-			if k == "" && v == "" {
-				out = append(out, fmt.Sprintf("    %s*", WHITE))
-				continue
-			}
-			out = append(out, fmt.Sprintf("    %s* %s%v = %s%v", WHITE, BLUE, k, WHITE, v))
-			if i == len(args)-2 {
-				out = append(out, CLEAR)
-			}
-		}
-	}
-
-	return strings.Join(out, "\n")
+	return string(AppendDEBUG(nil, time, name, title, args))
 }
 
 // NOTE output
 func NOTE(time time.Time, msg string, args ...interface{}) string {
-	out := []string{}
-	out = append(out, fmt.Sprintf("%s%v%s", INVERSE_WHITE, msg, CLEAR))
-
-	if len(args) == 1 {
-		out = append(out, fmt.Sprintf(" %s%v%s", WHITE, args[0], CLEAR))
-	} else {
-		for i := 0; i+1 < len(args); i += 2 {
-			k := args[i]
-			v := args[i+1]
-			if k == "" && v == "" {
-				out = append(out, fmt.Sprintf("    %s*", WHITE))
-				continue
-			}
-			out = append(out, fmt.Sprintf(" %s%v = %s%v", BLUE, k, WHITE, v))
-		}
-		out = append(out, CLEAR)
-	}
-
-	return strings.Join(out, "")
+	return string(AppendNOTE(nil, time, msg, args))
 }
 
 // NOTE2 output
 func NOTE2(time time.Time, msg string, args ...interface{}) string {
-	out := []string{}
-	out = append(out, fmt.Sprintf("%s%v%s:", INVERSE_BLUE, msg, CLEAR))
-
-	if len(args) == 1 {
-		out = append(out, fmt.Sprintf(" %s%v%s", WHITE, args[0], CLEAR))
-	} else {
-		for i := 0; i+1 < len(args); i += 2 {
-			out = append(out, fmt.Sprintf(" %s%v = %s%v", BLUE, args[i], WHITE, args[i+1]))
-		}
-		out = append(out, CLEAR)
-	}
-
-	return strings.Join(out, "")
+	return string(AppendNOTE2(nil, time, msg, args))
 }
 
 // WARNING output
 func WARNING(time time.Time, name, title string, args ...interface{}) string {
-	out := []string{}
-	out = append(out, fmt.Sprintf("\n%s%s\n%s%s%s", CYAN, name, INVERSE_YELLOW, title, CLEAR))
-
-	if len(args) == 1 {
-		out = append(out, fmt.Sprintf(" %s%v%s", WHITE, args[0], CLEAR))
-	} else {
-		for i := 0; i+1 < len(args); i += 2 {
-			k := args[i]
-			v := args[i+1]
-			if k == "" && v == "" {
-				out = append(out, fmt.Sprintf("    %s*", WHITE))
-				continue
-			}
-			out = append(out, fmt.Sprintf("    %s* %s%v = %s%v", WHITE, BLUE, k, WHITE, v))
-			if i == len(args)-2 {
-				out = append(out, CLEAR)
-			}
+	return string(AppendWARNING(nil, time, name, title, args))
+}
+
+// ERROR output
+func ERROR(time time.Time, name, title string, args ...interface{}) string {
+	return string(AppendERROR(nil, time, name, title, args))
+}
+
+// Appends DEBUG output to b
+func AppendDEBUG(b []byte, time time.Time, name, title string, args []interface{}) []byte {
+	return appendRecord(b, YELLOW, name, title, args)
+}
+
+// Appends WARNING output to b
+func AppendWARNING(b []byte, time time.Time, name, title string, args []interface{}) []byte {
+	return appendRecord(b, INVERSE_YELLOW, name, title, args)
+}
+
+// Appends ERROR output to b
+func AppendERROR(b []byte, time time.Time, name, title string, args []interface{}) []byte {
+	return appendRecord(b, INVERSE_RED, name, title, args)
+}
+
+// Appends NOTE output to b
+func AppendNOTE(b []byte, time time.Time, msg string, args []interface{}) []byte {
+	b = append(b, INVERSE_WHITE...)
+	b = append(b, msg...)
+	b = append(b, CLEAR...)
+
+	if field.IsSingle(args) {
+		return appendSingle(b, args[0])
+	}
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		if f.IsSeparator() {
+			b = append(b, "    "+WHITE+"*"...)
+			continue
 		}
+		b = appendInline(b, f)
 	}
+	return append(b, CLEAR...)
+}
 
-	return strings.Join(out, "\n")
+// Appends NOTE2 output to b
+func AppendNOTE2(b []byte, time time.Time, msg string, args []interface{}) []byte {
+	b = append(b, INVERSE_BLUE...)
+	b = append(b, msg...)
+	b = append(b, CLEAR+":"...)
+
+	if field.IsSingle(args) {
+		return appendSingle(b, args[0])
+	}
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		b = appendInline(b, f)
+	}
+	return append(b, CLEAR...)
 }
 
-// ERROR output
-func ERROR(time time.Time, name, title string, args ...interface{}) string {
-	out := []string{}
-	out = append(out, fmt.Sprintf("\n%s%s\n%s%s%s", CYAN, name, INVERSE_RED, title, CLEAR))
-
-	if len(args) == 1 {
-		out = append(out, fmt.Sprintf(" %s%v%s", WHITE, args[0], CLEAR))
-	} else {
-		for i := 0; i+1 < len(args); i += 2 {
-			k := args[i]
-			v := args[i+1]
-			if k == "" && v == "" {
-				out = append(out, fmt.Sprintf("    %s*", WHITE))
-				continue
-			}
-			out = append(out, fmt.Sprintf("    %s* %s%v = %s%v", WHITE, BLUE, k, WHITE, v))
-			if i == len(args)-2 {
-				out = append(out, CLEAR)
-			}
+// Name and title lines followed by argument per line
+func appendRecord(b []byte, titleColor, name, title string, args []interface{}) []byte {
+	b = append(b, "\n"+CYAN...)
+	b = append(b, name...)
+	b = append(b, '\n')
+	b = append(b, titleColor...)
+	b = append(b, title...)
+	b = append(b, CLEAR...)
+
+	if field.IsSingle(args) {
+		b = append(b, '\n')
+		return appendSingle(b, args[0])
+	}
+	for it := field.Iterate(args); it.More(); {
+		f, _ := it.Next()
+		b = append(b, '\n')
+		if f.IsSeparator() {
+			b = append(b, "    "+WHITE+"*"...)
+			continue
+		}
+		b = append(b, "    "+WHITE+"* "+BLUE...)
+		b = append(b, f.Key...)
+		b = append(b, " = "+WHITE...)
+		b = f.AppendValue(b)
+		if !it.More() {
+			b = append(b, "\n"+CLEAR...)
 		}
 	}
+	return b
+}
+
+// Single argument without a key
+func appendSingle(b []byte, v interface{}) []byte {
+	b = append(b, " "+WHITE...)
+	b = util.AppendValue(b, v)
+	return append(b, CLEAR...)
+}
 
-	return strings.Join(out, "\n")
+// Key and value on the same line
+func appendInline(b []byte, f field.Field) []byte {
+	b = append(b, " "+BLUE...)
+	b = append(b, f.Key...)
+	b = append(b, " = "+WHITE...)
+	return f.AppendValue(b)
 }